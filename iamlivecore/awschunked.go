@@ -0,0 +1,189 @@
+package iamlivecore
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Doc: https://docs.aws.amazon.com/AmazonS3/latest/API/sigv4-streaming.html
+
+const (
+	awsChunkStateSize = iota
+	awsChunkStateData
+	awsChunkStateDataEnd
+	awsChunkStateTrailer
+	awsChunkStateDone
+)
+
+// awsChunkedParser incrementally parses aws-chunked framing, collecting the decoded payload and trailers
+type awsChunkedParser struct {
+	state       int
+	line        []byte
+	remaining   int64
+	keepPayload bool
+	payload     bytes.Buffer
+	trailer     http.Header
+	err         error
+}
+
+func newAWSChunkedParser(keepPayload bool) *awsChunkedParser {
+	return &awsChunkedParser{
+		keepPayload: keepPayload,
+		trailer:     http.Header{},
+	}
+}
+
+func isAWSChunkedRequest(req *http.Request) bool {
+	return strings.Contains(strings.ToLower(req.Header.Get("Content-Encoding")), "aws-chunked") || strings.HasPrefix(req.Header.Get("X-Amz-Content-Sha256"), "STREAMING-")
+}
+
+// readLine accumulates data until a CRLF terminated line is available, returning the unconsumed input
+func (p *awsChunkedParser) readLine(data []byte) (line string, rest []byte, ok bool) {
+	i := bytes.IndexByte(data, '\n')
+	if i == -1 {
+		p.line = append(p.line, data...)
+		if len(p.line) > 4096 {
+			p.err = fmt.Errorf("aws-chunked line too long")
+		}
+		return "", nil, false
+	}
+
+	p.line = append(p.line, data[:i]...)
+	line = strings.TrimSuffix(string(p.line), "\r")
+	p.line = p.line[:0]
+
+	return line, data[i+1:], true
+}
+
+func (p *awsChunkedParser) write(data []byte) {
+	for len(data) > 0 && p.err == nil && p.state != awsChunkStateDone {
+		switch p.state {
+		case awsChunkStateSize:
+			line, rest, ok := p.readLine(data)
+			data = rest
+			if !ok {
+				continue
+			}
+
+			size, err := strconv.ParseInt(strings.TrimSpace(strings.Split(line, ";")[0]), 16, 64) // 400;chunk-signature=...
+			if err != nil || size < 0 {
+				p.err = fmt.Errorf("invalid aws-chunked chunk size %q", line)
+				continue
+			}
+
+			p.remaining = size
+			p.state = awsChunkStateData
+			if size == 0 {
+				p.state = awsChunkStateTrailer
+			}
+		case awsChunkStateData:
+			n := int64(len(data))
+			if n > p.remaining {
+				n = p.remaining
+			}
+			if p.keepPayload {
+				p.payload.Write(data[:n])
+			}
+			p.remaining -= n
+			data = data[n:]
+
+			if p.remaining == 0 {
+				p.state = awsChunkStateDataEnd
+			}
+		case awsChunkStateDataEnd:
+			line, rest, ok := p.readLine(data)
+			data = rest
+			if !ok {
+				continue
+			}
+
+			if line != "" {
+				p.err = fmt.Errorf("invalid aws-chunked chunk terminator")
+				continue
+			}
+			p.state = awsChunkStateSize
+		case awsChunkStateTrailer:
+			line, rest, ok := p.readLine(data)
+			data = rest
+			if !ok {
+				continue
+			}
+
+			if line == "" {
+				p.state = awsChunkStateDone
+				continue
+			}
+
+			colon := strings.Index(line, ":")
+			if colon < 1 {
+				p.err = fmt.Errorf("invalid aws-chunked trailer %q", line)
+				continue
+			}
+
+			name := strings.TrimSpace(line[:colon])
+			if strings.ToLower(name) != "x-amz-trailer-signature" {
+				p.trailer.Add(name, strings.TrimSpace(line[colon+1:]))
+			}
+		}
+	}
+}
+
+// decodeAWSChunked decodes a fully buffered aws-chunked body into its payload and trailers
+func decodeAWSChunked(body []byte) ([]byte, http.Header, error) {
+	parser := newAWSChunkedParser(true)
+	parser.write(body)
+
+	if parser.err != nil {
+		return nil, nil, parser.err
+	}
+	if parser.state != awsChunkStateDone && !(parser.state == awsChunkStateTrailer && len(parser.line) == 0) { // final CRLF is optional without trailers
+		return nil, nil, fmt.Errorf("truncated aws-chunked body")
+	}
+
+	return parser.payload.Bytes(), parser.trailer, nil
+}
+
+// awsChunkedReader passes a streamed aws-chunked body through unchanged, calling onComplete once with the
+// trailers when the framing ends or the body is closed
+type awsChunkedReader struct {
+	body       io.ReadCloser
+	parser     *awsChunkedParser
+	onComplete func(trailer http.Header)
+	once       sync.Once
+}
+
+func newAWSChunkedReader(body io.ReadCloser, onComplete func(trailer http.Header)) *awsChunkedReader {
+	return &awsChunkedReader{
+		body:       body,
+		parser:     newAWSChunkedParser(false),
+		onComplete: onComplete,
+	}
+}
+
+func (r *awsChunkedReader) complete() {
+	r.once.Do(func() {
+		r.onComplete(r.parser.trailer)
+	})
+}
+
+func (r *awsChunkedReader) Read(p []byte) (int, error) {
+	n, err := r.body.Read(p)
+	r.parser.write(p[:n])
+
+	if r.parser.state == awsChunkStateDone || r.parser.err != nil || err != nil {
+		r.complete()
+	}
+
+	return n, err
+}
+
+func (r *awsChunkedReader) Close() error {
+	r.complete()
+
+	return r.body.Close()
+}
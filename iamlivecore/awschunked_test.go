@@ -0,0 +1,145 @@
+package iamlivecore
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestDecodeAWSChunked(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		payload string
+		trailer http.Header
+		wantErr bool
+	}{
+		{
+			name:    "signed chunks",
+			body:    "5;chunk-signature=aa\r\nhello\r\n6;chunk-signature=bb\r\n world\r\n0;chunk-signature=cc\r\n\r\n",
+			payload: "hello world",
+			trailer: http.Header{},
+		},
+		{
+			name:    "trailers",
+			body:    "5\r\nhello\r\n0\r\nx-amz-checksum-crc32:AAAAAA==\r\nx-amz-trailer-signature:dd\r\n\r\n",
+			payload: "hello",
+			trailer: http.Header{"X-Amz-Checksum-Crc32": {"AAAAAA=="}},
+		},
+		{
+			name:    "no final CRLF without trailers",
+			body:    "5\r\nhello\r\n0\r\n",
+			payload: "hello",
+			trailer: http.Header{},
+		},
+		{
+			name:    "bare LF line endings",
+			body:    "5\nhello\n0\n\n",
+			payload: "hello",
+			trailer: http.Header{},
+		},
+		{name: "empty", body: "", wantErr: true},
+		{name: "invalid size", body: "zz\r\nhello\r\n0\r\n\r\n", wantErr: true},
+		{name: "negative size", body: "-5\r\nhello\r\n0\r\n\r\n", wantErr: true},
+		{name: "size overflow", body: "fffffffffffffffff\r\nhello\r\n0\r\n\r\n", wantErr: true},
+		{name: "chunk longer than its size", body: "3\r\nhello\r\n0\r\n\r\n", wantErr: true},
+		{name: "truncated data", body: "a\r\nhello", wantErr: true},
+		{name: "truncated before the last chunk", body: "5\r\nhello\r\n", wantErr: true},
+		{name: "truncated trailer", body: "5\r\nhello\r\n0\r\nx-amz-checksum-crc32:AAAA", wantErr: true},
+		{name: "trailer without a colon", body: "5\r\nhello\r\n0\r\nx-amz-checksum-crc32\r\n\r\n", wantErr: true},
+		{name: "trailer without a name", body: "5\r\nhello\r\n0\r\n:AAAA\r\n\r\n", wantErr: true},
+		{name: "line too long", body: string(bytes.Repeat([]byte("1"), 5000)), wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			payload, trailer, err := decodeAWSChunked([]byte(test.body))
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got payload %q", payload)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(payload) != test.payload {
+				t.Errorf("payload %q, want %q", payload, test.payload)
+			}
+			if !reflect.DeepEqual(trailer, test.trailer) {
+				t.Errorf("trailer %v, want %v", trailer, test.trailer)
+			}
+		})
+	}
+}
+
+// oneByteReader returns a byte per read, so framing is split across every boundary
+type oneByteReader struct {
+	data []byte
+}
+
+func (r *oneByteReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, io.EOF
+	}
+	p[0] = r.data[0]
+	r.data = r.data[1:]
+	return 1, nil
+}
+
+func (r *oneByteReader) Close() error {
+	return nil
+}
+
+func TestAWSChunkedReader(t *testing.T) {
+	body := "5;chunk-signature=aa\r\nhello\r\n0;chunk-signature=bb\r\nx-amz-checksum-sha256:abc=\r\n\r\n"
+
+	calls := 0
+	var trailer http.Header
+	reader := newAWSChunkedReader(&oneByteReader{data: []byte(body)}, func(t http.Header) {
+		calls++
+		trailer = t
+	})
+
+	passed, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader.Close()
+
+	if string(passed) != body {
+		t.Errorf("body changed in passing through: %q", passed)
+	}
+	if calls != 1 {
+		t.Errorf("onComplete called %d times", calls)
+	}
+	if trailer.Get("X-Amz-Checksum-Sha256") != "abc=" {
+		t.Errorf("trailer %v", trailer)
+	}
+}
+
+func FuzzDecodeAWSChunked(f *testing.F) {
+	f.Add([]byte("5;chunk-signature=aa\r\nhello\r\n0;chunk-signature=bb\r\n\r\n"))
+	f.Add([]byte("5\r\nhello\r\n0\r\nx-amz-checksum-crc32:AAAAAA==\r\n\r\n"))
+	f.Add([]byte("5\r\nhello\r\n0\r\n"))
+	f.Add([]byte{})
+	f.Add([]byte("zz\r\n"))
+	f.Add([]byte("0\r\n:\r\n\r\n"))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		payload, _, err := decodeAWSChunked(data)
+		if err == nil && len(payload) > len(data) {
+			t.Errorf("payload of %d bytes from a body of %d", len(payload), len(data))
+		}
+
+		// streaming the same body must pass it through unchanged
+		reader := newAWSChunkedReader(io.NopCloser(bytes.NewReader(data)), func(http.Header) {})
+		passed, _ := io.ReadAll(reader)
+		reader.Close()
+		if !bytes.Equal(passed, data) {
+			t.Errorf("body changed in passing through")
+		}
+	})
+}
@@ -0,0 +1,228 @@
+package iamlivecore
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Doc: https://docs.aws.amazon.com/sdkref/latest/guide/feature-retry-behavior.html
+
+var deniedExceptions = []string{"AccessDenied", "AccessDeniedException", "UnauthorizedOperation", "UnauthorizedException", "AuthorizationError", "AuthorizationErrorException", "NotAuthorized"}
+
+var throttlingExceptions = []string{"Throttling", "ThrottlingException", "ThrottledException", "RequestThrottledException", "TooManyRequestsException", "ProvisionedThroughputExceededException", "TransactionInProgressException", "RequestLimitExceeded", "BandwidthLimitExceeded", "LimitExceededException", "RequestThrottled", "SlowDown", "PriorRequestNotComplete", "EC2ThrottledException"}
+
+// CallStatsReport splits the CSM calls by the SDK client making them
+type CallStatsReport struct {
+	Clients []ClientCallStats `json:"Clients"`
+}
+
+// ClientCallStats is what one SDK client called, and the action-only policy it needs
+type ClientCallStats struct {
+	ClientID  string            `json:"ClientId"`
+	UserAgent string            `json:"UserAgent"`
+	Calls     []MethodCallStats `json:"Calls"`
+	Policy    IAMPolicy         `json:"Policy"`
+}
+
+// MethodCallStats is how the calls of a method fared. Calls are denied when their final exception denies access,
+// failed when it is anything else; attempts are counted apart, as throttling is usually retried away.
+type MethodCallStats struct {
+	Call              string   `json:"Call"`
+	Actions           []string `json:"Actions"`
+	Calls             int      `json:"Calls"`
+	Attempts          int      `json:"Attempts"`
+	Retries           int      `json:"Retries"`
+	Denied            int      `json:"Denied"`
+	Failed            int      `json:"Failed"`
+	ThrottledAttempts int      `json:"ThrottledAttempts"`
+	FailedAttempts    int      `json:"FailedAttempts"` // other than throttled
+	AverageLatency    int      `json:"AverageLatency"` // milliseconds, including retries
+	MaxLatency        int      `json:"MaxLatency"`
+	DeniedMessages    []string `json:"DeniedMessages,omitempty"`
+}
+
+func isExceptionIn(exception string, exceptions []string) bool {
+	for _, e := range exceptions {
+		if exception == e {
+			return true
+		}
+	}
+	return false
+}
+
+// getClientStats returns the stats of the client, adding them to the report when new
+func (report *CallStatsReport) getClientStats(entry Entry) *ClientCallStats {
+	for i := range report.Clients {
+		if report.Clients[i].ClientID == entry.ClientID && report.Clients[i].UserAgent == entry.UserAgent {
+			return &report.Clients[i]
+		}
+	}
+
+	report.Clients = append(report.Clients, ClientCallStats{
+		ClientID:  entry.ClientID,
+		UserAgent: entry.UserAgent,
+		Calls:     []MethodCallStats{},
+	})
+	return &report.Clients[len(report.Clients)-1]
+}
+
+func (client *ClientCallStats) getMethodStats(s *Session, entry Entry) *MethodCallStats {
+	call := entry.Service + "." + entry.Method
+	for i := range client.Calls {
+		if client.Calls[i].Call == call {
+			return &client.Calls[i]
+		}
+	}
+
+	client.Calls = append(client.Calls, MethodCallStats{
+		Call:    call,
+		Actions: s.getActions(entry.Service, entry.Method),
+	})
+	return &client.Calls[len(client.Calls)-1]
+}
+
+func (s *Session) getCallStatsReport() CallStatsReport {
+	report := CallStatsReport{
+		Clients: []ClientCallStats{},
+	}
+
+	callLog, _, _, _ := s.getCallLogs()
+	s.mu.Lock()
+	attemptLog := append([]Entry{}, s.attemptLog...)
+	s.mu.Unlock()
+
+	latencies := map[string]int{} // total latency by client and call
+
+	for _, entry := range callLog {
+		if entry.Type != "ApiCall" {
+			continue
+		}
+
+		client := report.getClientStats(entry)
+		stats := client.getMethodStats(s, entry)
+
+		stats.Calls++
+		if entry.AttemptCount > 1 {
+			stats.Retries += entry.AttemptCount - 1
+		}
+		if isExceptionIn(entry.FinalAWSException, deniedExceptions) {
+			stats.Denied++
+			if entry.FinalAWSExceptionMessage != "" {
+				stats.DeniedMessages = uniqueSlice(append(stats.DeniedMessages, entry.FinalAWSExceptionMessage))
+			}
+		} else if entry.FinalAWSException != "" || entry.FinalHTTPStatusCode >= 300 {
+			stats.Failed++
+		}
+		latencies[entry.ClientID+"\x00"+entry.UserAgent+"\x00"+stats.Call] += entry.Latency
+		if entry.Latency > stats.MaxLatency {
+			stats.MaxLatency = entry.Latency
+		}
+	}
+
+	for _, entry := range attemptLog {
+		stats := report.getClientStats(entry).getMethodStats(s, entry)
+
+		stats.Attempts++
+		if isExceptionIn(entry.AWSException, throttlingExceptions) || entry.HTTPStatusCode == 429 {
+			stats.ThrottledAttempts++
+		} else if entry.AWSException != "" || entry.HTTPStatusCode >= 300 {
+			stats.FailedAttempts++
+		}
+	}
+
+	for i := range report.Clients {
+		client := &report.Clients[i]
+
+		actions := []string{}
+		for j := range client.Calls {
+			stats := &client.Calls[j]
+			if stats.Calls > 0 {
+				stats.AverageLatency = latencies[client.ClientID+"\x00"+client.UserAgent+"\x00"+stats.Call] / stats.Calls
+				actions = append(actions, getDependantActions(stats.Actions)...)
+			}
+			if stats.Attempts < stats.Calls+stats.Retries { // not every SDK sends attempts
+				stats.Attempts = stats.Calls + stats.Retries
+			}
+		}
+
+		actions = uniqueSlice(actions)
+		if s.options.SortAlphabetical {
+			sort.Strings(actions)
+		}
+		client.Policy = IAMPolicy{
+			Version: "2012-10-17",
+			Statement: []Statement{{
+				Effect:   "Allow",
+				Resource: "*",
+				Action:   actions,
+			}},
+		}
+
+		sort.SliceStable(client.Calls, func(i, j int) bool { return client.Calls[i].Call < client.Calls[j].Call })
+	}
+
+	sort.SliceStable(report.Clients, func(i, j int) bool {
+		if report.Clients[i].ClientID != report.Clients[j].ClientID {
+			return report.Clients[i].ClientID < report.Clients[j].ClientID
+		}
+		return report.Clients[i].UserAgent < report.Clients[j].UserAgent
+	})
+
+	return report
+}
+
+// CallStats returns the outcomes, retries and latency of the CSM calls, split by SDK client
+func (s *Session) CallStats() CallStatsReport {
+	return s.getCallStatsReport()
+}
+
+// CallStatsDocument returns the call stats as JSON
+func (s *Session) CallStatsDocument() []byte {
+	doc, err := json.MarshalIndent(s.getCallStatsReport(), "", "    ")
+	if err != nil {
+		panic(err)
+	}
+	return doc
+}
+
+// getCallStatsSummary returns the call stats as shown beneath the policy in the terminal
+func (s *Session) getCallStatsSummary() string {
+	report := s.getCallStatsReport()
+
+	lines := []string{"Calls:"}
+	denied := []string{}
+	for _, client := range report.Clients {
+		name := client.ClientID
+		if name == "" {
+			name = "(no client ID)"
+		}
+		if client.UserAgent != "" {
+			name += " " + client.UserAgent
+		}
+		lines = append(lines, "  "+name)
+
+		for _, stats := range client.Calls {
+			line := fmt.Sprintf("    %s  %d calls, %d retries, %dms average, %dms max", strings.Join(stats.Actions, ", "), stats.Calls, stats.Retries, stats.AverageLatency, stats.MaxLatency)
+			if stats.ThrottledAttempts > 0 {
+				line += fmt.Sprintf(", %d throttled", stats.ThrottledAttempts)
+			}
+			if stats.Failed > 0 {
+				line += fmt.Sprintf(", %d failed", stats.Failed)
+			}
+			if stats.Denied > 0 {
+				line += fmt.Sprintf(", %d denied", stats.Denied)
+				denied = append(denied, fmt.Sprintf("  %s (%s)", strings.Join(stats.Actions, ", "), strings.Join(stats.DeniedMessages, "; ")))
+			}
+			lines = append(lines, line)
+		}
+	}
+
+	if len(denied) > 0 {
+		lines = append(lines, "Denied:")
+		lines = append(lines, uniqueSlice(denied)...)
+	}
+
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,269 @@
+package iamlivecore
+
+import (
+	b64 "encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// Doc: https://www.rfc-editor.org/rfc/rfc8949.html
+
+const cborMaxDepth = 64
+
+type cborDecoder struct {
+	data []byte
+	pos  int
+}
+
+var errCBORBreak = fmt.Errorf("unexpected CBOR break")
+
+// decodeCBOR decodes a single CBOR data item into maps, slices and scalars so that it can be flattened like a JSON
+// body. Byte strings become base64 strings, matching how blobs are represented in JSON.
+func decodeCBOR(data []byte) (interface{}, error) {
+	decoder := &cborDecoder{data: data}
+
+	value, err := decoder.decode(0)
+	if err != nil {
+		return nil, err
+	}
+	if decoder.pos != len(data) {
+		return nil, fmt.Errorf("trailing data after CBOR item")
+	}
+
+	return value, nil
+}
+
+func (d *cborDecoder) readByte() (byte, error) {
+	if d.pos >= len(d.data) {
+		return 0, fmt.Errorf("unexpected end of CBOR data")
+	}
+	b := d.data[d.pos]
+	d.pos++
+	return b, nil
+}
+
+func (d *cborDecoder) readBytes(n uint64) ([]byte, error) {
+	if n > uint64(len(d.data)-d.pos) {
+		return nil, fmt.Errorf("unexpected end of CBOR data")
+	}
+	b := d.data[d.pos : d.pos+int(n)]
+	d.pos += int(n)
+	return b, nil
+}
+
+// readArgument reads the argument following the initial byte, returning indefinite when the length is indefinite
+func (d *cborDecoder) readArgument(info byte) (arg uint64, indefinite bool, err error) {
+	switch {
+	case info < 24:
+		return uint64(info), false, nil
+	case info == 24:
+		b, err := d.readBytes(1)
+		if err != nil {
+			return 0, false, err
+		}
+		return uint64(b[0]), false, nil
+	case info == 25:
+		b, err := d.readBytes(2)
+		if err != nil {
+			return 0, false, err
+		}
+		return uint64(binary.BigEndian.Uint16(b)), false, nil
+	case info == 26:
+		b, err := d.readBytes(4)
+		if err != nil {
+			return 0, false, err
+		}
+		return uint64(binary.BigEndian.Uint32(b)), false, nil
+	case info == 27:
+		b, err := d.readBytes(8)
+		if err != nil {
+			return 0, false, err
+		}
+		return binary.BigEndian.Uint64(b), false, nil
+	case info == 31:
+		return 0, true, nil
+	}
+
+	return 0, false, fmt.Errorf("invalid CBOR additional information %d", info)
+}
+
+// readString reads a definite or indefinite length byte or text string of the given major type
+func (d *cborDecoder) readString(major byte, info byte) ([]byte, error) {
+	length, indefinite, err := d.readArgument(info)
+	if err != nil {
+		return nil, err
+	}
+	if !indefinite {
+		return d.readBytes(length)
+	}
+
+	var result []byte
+	for {
+		initial, err := d.readByte()
+		if err != nil {
+			return nil, err
+		}
+		if initial == 0xff {
+			return result, nil
+		}
+		if initial>>5 != major || initial&0x1f == 31 {
+			return nil, fmt.Errorf("invalid CBOR indefinite string chunk")
+		}
+		chunk, err := d.readString(major, initial&0x1f)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, chunk...)
+	}
+}
+
+func (d *cborDecoder) decode(depth int) (interface{}, error) {
+	if depth > cborMaxDepth {
+		return nil, fmt.Errorf("CBOR nesting too deep")
+	}
+
+	initial, err := d.readByte()
+	if err != nil {
+		return nil, err
+	}
+	major := initial >> 5
+	info := initial & 0x1f
+
+	switch major {
+	case 0: // unsigned integer
+		arg, _, err := d.readArgument(info)
+		if err != nil || info == 31 {
+			return nil, fmt.Errorf("invalid CBOR integer")
+		}
+		return arg, nil
+	case 1: // negative integer
+		arg, _, err := d.readArgument(info)
+		if err != nil || info == 31 {
+			return nil, fmt.Errorf("invalid CBOR integer")
+		}
+		if arg > math.MaxInt64 {
+			return -1 - float64(arg), nil
+		}
+		return -1 - int64(arg), nil
+	case 2: // byte string
+		b, err := d.readString(major, info)
+		if err != nil {
+			return nil, err
+		}
+		return b64.StdEncoding.EncodeToString(b), nil
+	case 3: // text string
+		b, err := d.readString(major, info)
+		if err != nil {
+			return nil, err
+		}
+		return string(b), nil
+	case 4: // array
+		length, indefinite, err := d.readArgument(info)
+		if err != nil {
+			return nil, err
+		}
+		if !indefinite && length > uint64(len(d.data)-d.pos) { // each item is at least one byte
+			return nil, fmt.Errorf("invalid CBOR array length")
+		}
+		arr := []interface{}{}
+		for i := uint64(0); indefinite || i < length; i++ {
+			item, err := d.decode(depth + 1)
+			if err == errCBORBreak && indefinite {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			arr = append(arr, item)
+		}
+		return arr, nil
+	case 5: // map
+		length, indefinite, err := d.readArgument(info)
+		if err != nil {
+			return nil, err
+		}
+		if !indefinite && length > uint64(len(d.data)-d.pos)/2 {
+			return nil, fmt.Errorf("invalid CBOR map length")
+		}
+		obj := map[string]interface{}{}
+		for i := uint64(0); indefinite || i < length; i++ {
+			key, err := d.decode(depth + 1)
+			if err == errCBORBreak && indefinite {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			value, err := d.decode(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			obj[fmt.Sprintf("%v", key)] = value
+		}
+		return obj, nil
+	case 6: // tag, e.g. epoch timestamps, use the tagged item as-is
+		if _, _, err := d.readArgument(info); err != nil || info == 31 {
+			return nil, fmt.Errorf("invalid CBOR tag")
+		}
+		return d.decode(depth + 1)
+	}
+
+	// major type 7, simple values and floats
+	switch info {
+	case 20:
+		return false, nil
+	case 21:
+		return true, nil
+	case 22, 23:
+		return nil, nil
+	case 24:
+		_, err := d.readBytes(1)
+		return nil, err
+	case 25:
+		b, err := d.readBytes(2)
+		if err != nil {
+			return nil, err
+		}
+		return float64(halfToFloat32(binary.BigEndian.Uint16(b))), nil
+	case 26:
+		b, err := d.readBytes(4)
+		if err != nil {
+			return nil, err
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), nil
+	case 27:
+		b, err := d.readBytes(8)
+		if err != nil {
+			return nil, err
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), nil
+	case 31:
+		return nil, errCBORBreak
+	}
+
+	if info < 20 { // unassigned simple values
+		return nil, nil
+	}
+
+	return nil, fmt.Errorf("invalid CBOR simple value %d", info)
+}
+
+func halfToFloat32(half uint16) float32 {
+	sign := uint32(half>>15) << 31
+	exponent := uint32(half>>10) & 0x1f
+	mantissa := uint32(half) & 0x3ff
+
+	switch exponent {
+	case 0: // subnormal
+		value := float32(mantissa) / 1024 / 16384
+		if sign != 0 {
+			return -value
+		}
+		return value
+	case 0x1f: // infinity and NaN
+		return math.Float32frombits(sign | 0x7f800000 | mantissa<<13)
+	}
+
+	return math.Float32frombits(sign | (exponent+112)<<23 | mantissa<<13)
+}
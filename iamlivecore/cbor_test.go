@@ -0,0 +1,95 @@
+package iamlivecore
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestDecodeCBOR(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    []byte
+		want    interface{}
+		wantErr bool
+	}{
+		{name: "unsigned integer", data: []byte{0x18, 0x64}, want: uint64(100)},
+		{name: "negative integer", data: []byte{0x38, 0x63}, want: int64(-100)},
+		{name: "text string", data: []byte{0x63, 'a', 'b', 'c'}, want: "abc"},
+		{name: "byte string as base64", data: []byte{0x43, 0x01, 0x02, 0x03}, want: "AQID"},
+		{name: "half float", data: []byte{0xf9, 0x3c, 0x00}, want: float64(1)},
+		{name: "double", data: []byte{0xfb, 0x3f, 0xf8, 0, 0, 0, 0, 0, 0}, want: 1.5},
+		{name: "simple values", data: []byte{0x83, 0xf4, 0xf5, 0xf6}, want: []interface{}{false, true, nil}},
+		{name: "tagged timestamp", data: []byte{0xc1, 0x1a, 0x5f, 0x5e, 0x10, 0x00}, want: uint64(1600000000)},
+		{
+			name: "map",
+			data: []byte{0xa2, 0x64, 'N', 'a', 'm', 'e', 0x61, 'q', 0x64, 'T', 'a', 'g', 's', 0x82, 0x01, 0x02},
+			want: map[string]interface{}{"Name": "q", "Tags": []interface{}{uint64(1), uint64(2)}},
+		},
+		{name: "indefinite array", data: []byte{0x9f, 0x01, 0x02, 0xff}, want: []interface{}{uint64(1), uint64(2)}},
+		{name: "indefinite map", data: []byte{0xbf, 0x61, 'a', 0x01, 0xff}, want: map[string]interface{}{"a": uint64(1)}},
+		{name: "indefinite text string", data: []byte{0x7f, 0x62, 'a', 'b', 0x61, 'c', 0xff}, want: "abc"},
+		{name: "indefinite byte string", data: []byte{0x5f, 0x41, 0x01, 0x42, 0x02, 0x03, 0xff}, want: "AQID"},
+
+		{name: "empty", data: []byte{}, wantErr: true},
+		{name: "truncated text string", data: []byte{0x63, 'a'}, wantErr: true},
+		{name: "truncated argument", data: []byte{0x19, 0x01}, wantErr: true},
+		{name: "reserved additional information", data: []byte{0x1c}, wantErr: true},
+		{name: "indefinite integer", data: []byte{0x1f}, wantErr: true},
+		{name: "array longer than the data", data: []byte{0x9b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, wantErr: true},
+		{name: "map longer than the data", data: []byte{0xa5, 0x01}, wantErr: true},
+		{name: "unterminated indefinite array", data: []byte{0x9f, 0x01}, wantErr: true},
+		{name: "unterminated indefinite string", data: []byte{0x7f, 0x61, 'a'}, wantErr: true},
+		{name: "indefinite string chunk of another type", data: []byte{0x7f, 0x41, 0x01, 0xff}, wantErr: true},
+		{name: "nested indefinite string chunk", data: []byte{0x7f, 0x7f, 0xff, 0xff}, wantErr: true},
+		{name: "break outside an indefinite item", data: []byte{0xff}, wantErr: true},
+		{name: "break in a definite array", data: []byte{0x82, 0x01, 0xff}, wantErr: true},
+		{name: "break in place of a map value", data: []byte{0xbf, 0x61, 'a', 0xff}, wantErr: true},
+		{name: "trailing data", data: []byte{0x01, 0x02}, wantErr: true},
+		{name: "nested too deep", data: append(bytes.Repeat([]byte{0x81}, cborMaxDepth+1), 0x01), wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := decodeCBOR(test.data)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %#v, want %#v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestDecodeCBORDepthLimit(t *testing.T) {
+	nested := append(bytes.Repeat([]byte{0x81}, cborMaxDepth), 0x01) // the deepest nesting allowed
+	if _, err := decodeCBOR(nested); err != nil {
+		t.Errorf("nesting of %d: %v", cborMaxDepth, err)
+	}
+
+	tagged := append(bytes.Repeat([]byte{0xc1}, cborMaxDepth+1), 0x01) // tags count towards the depth
+	if _, err := decodeCBOR(tagged); err == nil {
+		t.Error("expected an error for deeply nested tags")
+	}
+}
+
+func FuzzDecodeCBOR(f *testing.F) {
+	f.Add([]byte{0xa2, 0x64, 'N', 'a', 'm', 'e', 0x61, 'q', 0x64, 'T', 'a', 'g', 's', 0x82, 0x01, 0x02})
+	f.Add([]byte{0xbf, 0x61, 'a', 0x9f, 0x01, 0xff, 0xff})
+	f.Add([]byte{0x7f, 0x62, 'a', 'b', 0xff})
+	f.Add([]byte{0xc1, 0xfb, 0x41, 0xd7, 0xd7, 0x84, 0x00, 0x00, 0x00, 0x00})
+	f.Add([]byte{})
+	f.Add([]byte{0xff})
+	f.Add(bytes.Repeat([]byte{0x9f}, 100))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		decodeCBOR(data) // must return, with an error for anything malformed, rather than panic
+	})
+}
@@ -0,0 +1,221 @@
+package iamlivecore
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// CoverageReport lists the calls and resources of the AWS policy which shouldn't be trusted as-is
+type CoverageReport struct {
+	Unrecognized      []CoverageCall     `json:"Unrecognized"`      // calls left out of the policy
+	Fallback          []CoverageCall     `json:"Fallback"`          // calls whose actions were guessed from the method name
+	WildcardResources []CoverageResource `json:"WildcardResources"` // resources which collapsed to wildcards
+}
+
+// CoverageCall is a call, or a request which couldn't be matched to a call, and how often it was made
+type CoverageCall struct {
+	Call    string   `json:"Call"` // Service.Method, or the HTTP method and URL of the request
+	Reason  string   `json:"Reason"`
+	Actions []string `json:"Actions,omitempty"`
+	Count   int      `json:"Count"`
+}
+
+// CoverageResource is a resource of a statement which has wildcards in place of unresolved template variables
+type CoverageResource struct {
+	Call                string   `json:"Call"`
+	Action              string   `json:"Action"`
+	Resource            string   `json:"Resource"`
+	Template            string   `json:"Template,omitempty"`
+	UnresolvedVariables []string `json:"UnresolvedVariables,omitempty"`
+	Count               int      `json:"Count"`
+}
+
+// unrecognizedEntry is a request to an AWS endpoint which matched no operation of the API definitions
+type unrecognizedEntry struct {
+	HTTPMethod          string
+	Host                string
+	Path                string
+	FinalHTTPStatusCode int
+}
+
+func addCoverageCall(calls []CoverageCall, call string, reason string, actions []string) []CoverageCall {
+	for i := range calls {
+		if calls[i].Call == call && calls[i].Reason == reason {
+			calls[i].Count++
+			return calls
+		}
+	}
+
+	return append(calls, CoverageCall{
+		Call:    call,
+		Reason:  reason,
+		Actions: actions,
+		Count:   1,
+	})
+}
+
+// addWildcardResources records in the report the resources resolved from a template which still have wildcards, a
+// nil report recording nothing
+func (s *Session) addWildcardResources(report *CoverageReport, call Entry, action string, template string, resources []string) {
+	if report == nil {
+		return
+	}
+
+	unresolvedVariables := []string{}
+	if template != "" {
+		_, arns := s.subARNParameters(template, call, true)
+		for _, arn := range arns {
+			for _, variableMatch := range arnVariableRegex.FindAllStringSubmatch(arn, -1) {
+				if variableMatch[1] != "Partition" && variableMatch[1] != "Region" && variableMatch[1] != "Account" && !s.isPreservedPolicyVariable(variableMatch[1]) {
+					unresolvedVariables = append(unresolvedVariables, variableMatch[1])
+				}
+			}
+		}
+	}
+
+	callName := call.Service + "." + call.Method
+
+ResourceLoop:
+	for _, resource := range resources {
+		for i := range report.WildcardResources {
+			existing := &report.WildcardResources[i]
+			if existing.Call == callName && existing.Action == action && existing.Resource == resource {
+				existing.Count++
+				continue ResourceLoop
+			}
+		}
+
+		report.WildcardResources = append(report.WildcardResources, CoverageResource{
+			Call:                callName,
+			Action:              action,
+			Resource:            resource,
+			Template:            template,
+			UnresolvedVariables: uniqueSlice(unresolvedVariables),
+			Count:               1,
+		})
+	}
+}
+
+// hasIAMMapping returns whether the method is mapped or known to need no permissions
+func (s *Session) hasIAMMapping(service, method string) bool {
+	lowerPriv := strings.ToLower(fmt.Sprintf("%s.%s", service, method))
+
+	for _, permissionlessAction := range s.iamMap.SDKPermissionlessActions {
+		if strings.ToLower(permissionlessAction) == lowerPriv {
+			return true
+		}
+	}
+	for sdkCall := range s.iamMap.SDKMethodIAMMappings {
+		if strings.ToLower(sdkCall) == lowerPriv {
+			return true
+		}
+	}
+
+	return false
+}
+
+// hasSARResourceTypes returns whether the action can be scoped to resources, so that a wildcard is a loss of detail
+func hasSARResourceTypes(action string) bool {
+	service, privilege, _ := getSARPrivilege(action)
+	if privilege == nil {
+		return false
+	}
+
+	return len(getSARResourceArns(service, *privilege)) > 0
+}
+
+func (s *Session) getCoverageReport() CoverageReport {
+	report := CoverageReport{
+		Unrecognized:      []CoverageCall{},
+		Fallback:          []CoverageCall{},
+		WildcardResources: []CoverageResource{},
+	}
+
+	callLog, _, _, unrecognizedCallLog := s.getCallLogs()
+
+	for _, entry := range unrecognizedCallLog {
+		if s.options.FailsOnly && (entry.FinalHTTPStatusCode >= 200 && entry.FinalHTTPStatusCode <= 299) {
+			continue
+		}
+
+		report.Unrecognized = addCoverageCall(report.Unrecognized, fmt.Sprintf("%s %s%s", entry.HTTPMethod, entry.Host, entry.Path), "no operation of the API definitions matched the request", nil)
+	}
+
+	if s.options.Mode == "hybrid" { // leaving out the CSM calls the proxy saw
+		proxyCalls, csmOnlyCalls := s.correlateHybridCalls(callLog)
+		callLog = append(proxyCalls, csmOnlyCalls...)
+	}
+
+	for _, entry := range callLog {
+		if s.options.FailsOnly && (entry.FinalHTTPStatusCode >= 200 && entry.FinalHTTPStatusCode <= 299) {
+			continue
+		}
+
+		callName := entry.Service + "." + entry.Method
+		hasResources := s.options.Mode == "proxy" || (s.options.Mode == "hybrid" && entry.Type == "ProxyCall")
+
+		if s.hasIAMMapping(entry.Service, entry.Method) {
+			if hasResources {
+				s.resolveProxyCallStatements(entry, &report)
+			}
+		} else if hasResources {
+			report.Unrecognized = addCoverageCall(report.Unrecognized, callName, "the method has no mapping", nil)
+		} else {
+			report.Fallback = addCoverageCall(report.Fallback, callName, "the method has no mapping, the action is guessed from its name", s.getActions(entry.Service, entry.Method))
+		}
+	}
+
+	sort.SliceStable(report.Unrecognized, func(i, j int) bool { return report.Unrecognized[i].Call < report.Unrecognized[j].Call })
+	sort.SliceStable(report.Fallback, func(i, j int) bool { return report.Fallback[i].Call < report.Fallback[j].Call })
+	sort.SliceStable(report.WildcardResources, func(i, j int) bool {
+		if report.WildcardResources[i].Call != report.WildcardResources[j].Call {
+			return report.WildcardResources[i].Call < report.WildcardResources[j].Call
+		}
+		return report.WildcardResources[i].Action < report.WildcardResources[j].Action
+	})
+
+	return report
+}
+
+// CoverageReport returns the coverage report of the AWS policy
+func (s *Session) CoverageReport() CoverageReport {
+	return s.getCoverageReport()
+}
+
+// CoverageReportDocument returns the coverage report of the AWS policy as JSON
+func (s *Session) CoverageReportDocument() []byte {
+	doc, err := json.MarshalIndent(s.getCoverageReport(), "", "    ")
+	if err != nil {
+		panic(err)
+	}
+	return doc
+}
+
+// GetCoverageReport returns the coverage report of the AWS policy for the default session
+func GetCoverageReport() []byte {
+	return getDefaultSession().CoverageReportDocument()
+}
+
+// getCoverageSummary returns the coverage report as shown beneath the policy in the terminal
+func (s *Session) getCoverageSummary() string {
+	report := s.getCoverageReport()
+
+	lines := []string{fmt.Sprintf("Coverage: %d unrecognized, %d fallback, %d wildcard resources", len(report.Unrecognized), len(report.Fallback), len(report.WildcardResources))}
+	for _, call := range report.Unrecognized {
+		lines = append(lines, fmt.Sprintf("  unrecognized  %s (%s)", call.Call, call.Reason))
+	}
+	for _, call := range report.Fallback {
+		lines = append(lines, fmt.Sprintf("  fallback      %s -> %s", call.Call, strings.Join(call.Actions, ", ")))
+	}
+	for _, resource := range report.WildcardResources {
+		line := fmt.Sprintf("  wildcard      %s %s", resource.Action, resource.Resource)
+		if len(resource.UnresolvedVariables) > 0 {
+			line += " (unresolved ${" + strings.Join(resource.UnresolvedVariables, "}, ${") + "})"
+		}
+		lines = append(lines, line)
+	}
+
+	return strings.Join(lines, "\n")
+}
@@ -4,16 +4,10 @@ import (
 	"bufio"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
-	"log"
 	"net"
 	"os"
-	"os/signal"
-	"runtime/pprof"
 	"strings"
-	"syscall"
-
-	"github.com/mitchellh/go-homedir"
+	"time"
 )
 
 func setConfigKey(filename, section, line string, unset bool) error {
@@ -64,148 +58,154 @@ func setConfigKey(filename, section, line string, unset bool) error {
 	return writer.Flush()
 }
 
-func setINIConfigAndFileFlush() {
-	cfgfilepath := "~/.aws/config"
-	if os.Getenv("AWS_CONFIG_FILE") != "" {
-		cfgfilepath = os.Getenv("AWS_CONFIG_FILE")
-	}
+// CSMStats counts the CSM datagrams a session received and what became of the entries in them
+type CSMStats struct {
+	Datagrams      int
+	Calls          int // ApiCall entries recorded
+	Attempts       int // ApiCallAttempt entries
+	Permissionless int // ApiCall entries of methods needing no permissions
+	Rejected       int // entries which weren't CSM records
+	Forwarded      int // datagrams sent on to CSMForward targets, once per target
+	ForwardErrors  int
+	BufferErrors   int         // datagrams which couldn't be written to CSMBufferFile
+	RecentRejects  []CSMReject // the last rejected entries, oldest first
+}
 
-	// set ini
-	if *setiniFlag {
-		cfgfile, err := homedir.Expand(cfgfilepath)
-		if err != nil {
-			log.Fatal(err)
+// CSMReject is an entry of a datagram which wasn't a CSM record, and why
+type CSMReject struct {
+	Payload string // truncated to 1KB
+	Reason  string
+}
+
+const maxCSMRejects = 20
+
+// parseCSMDatagram returns the CSM records of a datagram, which holds one JSON entry per line, along with those
+// entries which aren't records
+func parseCSMDatagram(data []byte) ([]Entry, []CSMReject) {
+	entries := []Entry{}
+	rejects := []CSMReject{}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" { // a trailing newline
+			continue
 		}
 
-		if *profileFlag == "default" {
-			if *modeFlag == "csm" {
-				err = setConfigKey(cfgfile, "default", "csm_enabled = true", false)
-			} else if *modeFlag == "proxy" {
-				caBundlePath, err := homedir.Expand(*caBundleFlag)
-				if err != nil {
-					log.Fatal(err)
-				}
-				err = setConfigKey(cfgfile, "default", fmt.Sprintf("ca_bundle = %s", caBundlePath), false)
-			}
-		} else {
-			if *modeFlag == "csm" {
-				err = setConfigKey(cfgfile, fmt.Sprintf("profile %s", *profileFlag), "csm_enabled = true", false)
-			} else if *modeFlag == "proxy" {
-				caBundlePath, err := homedir.Expand(*caBundleFlag)
-				if err != nil {
-					log.Fatal(err)
-				}
-				err = setConfigKey(cfgfile, fmt.Sprintf("profile %s", *profileFlag), fmt.Sprintf("ca_bundle = %s", caBundlePath), false)
+		reject := func(reason string) {
+			payload := line
+			if len(payload) > 1024 {
+				payload = payload[:1024]
 			}
+			rejects = append(rejects, CSMReject{Payload: payload, Reason: reason})
 		}
 
-		if err != nil {
-			log.Fatal(err)
+		var e Entry
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			reject(err.Error())
+			continue
 		}
-	}
-
-	// listen for exit, cleanup and flush
-	sigc := make(chan os.Signal, 1)
-	signal.Notify(sigc,
-		syscall.SIGHUP,
-		syscall.SIGINT,
-		syscall.SIGTERM,
-		syscall.SIGQUIT)
-	go func() {
-		for s := range sigc {
-			// flush to file
-			if *outputFileFlag != "" {
-				err := ioutil.WriteFile(*outputFileFlag, GetPolicyDocument(), 0644)
-				if err != nil {
-					log.Fatalf("Error writing policy to %s", *outputFileFlag)
-				}
-			}
 
-			if s == syscall.SIGINT || s == syscall.SIGTERM || s == syscall.SIGQUIT {
-				if *setiniFlag {
-					// revert ini
-					cfgfile, err := homedir.Expand(cfgfilepath) // need to redeclare
-					if err != nil {
-						os.Exit(1)
-					}
-
-					if *profileFlag == "default" {
-						if *modeFlag == "csm" {
-							setConfigKey(cfgfile, "default", "csm_enabled = true", true)
-						} else if *modeFlag == "proxy" {
-							caBundlePath, _ := homedir.Expand(*caBundleFlag)
-							setConfigKey(cfgfile, "default", fmt.Sprintf("ca_bundle = %s", caBundlePath), true)
-						}
-					} else {
-						if *modeFlag == "csm" {
-							setConfigKey(cfgfile, fmt.Sprintf("profile %s", *profileFlag), "csm_enabled = true", true)
-						} else if *modeFlag == "proxy" {
-							caBundlePath, _ := homedir.Expand(*caBundleFlag)
-							setConfigKey(cfgfile, fmt.Sprintf("profile %s", *profileFlag), fmt.Sprintf("ca_bundle = %s", caBundlePath), true)
-						}
-					}
-				}
-
-				pprof.StopCPUProfile()
-
-				// exit
-				os.Exit(0)
+		switch e.Type {
+		case "ApiCall", "ApiCallAttempt":
+			if e.Service == "" || e.Method == "" {
+				reject("missing Service or Api")
+				continue
 			}
+		case "":
+			reject("missing Type")
+			continue
+		default:
+			reject(fmt.Sprintf("unknown record type %q", e.Type))
+			continue
 		}
-	}()
+
+		entries = append(entries, e)
+	}
+
+	return entries, rejects
 }
 
-func listenForEvents() {
-	var iamMap iamMapBase
+// CSMStats returns the counts of the CSM datagrams received so far
+func (s *Session) CSMStats() CSMStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	addr := net.UDPAddr{
-		Port: *csmPortFlag,
-		IP:   net.ParseIP(*hostFlag),
-	}
-	conn, err := net.ListenUDP("udp", &addr)
-	if err != nil {
-		panic(err)
-	}
-	err = conn.SetReadBuffer(1048576)
-	if err != nil {
-		panic(err)
-	}
-	defer conn.Close()
+	stats := s.csmStats
+	stats.RecentRejects = append([]CSMReject{}, s.csmStats.RecentRejects...)
+	return stats
+}
 
-	err = json.Unmarshal(bIAMMap, &iamMap)
-	if err != nil {
-		panic(err)
+func (s *Session) isPermissionless(service, method string) bool {
+	for _, permissionlessAction := range s.iamMap.SDKPermissionlessActions {
+		if strings.ToLower(permissionlessAction) == fmt.Sprintf("%s.%s", strings.ToLower(service), strings.ToLower(method)) {
+			return true
+		}
 	}
 
+	return false
+}
+
+// listenForEvents records the API calls reported to the CSM listener, until the connection is closed
+func (s *Session) listenForEvents(conn net.PacketConn) error {
 	var buf [1048576]byte
 	for {
-		rlen, _, err := conn.ReadFromUDP(buf[:])
+		rlen, _, err := conn.ReadFrom(buf[:])
 		if err != nil {
-			panic(err)
+			return err
 		}
 
-		entries := strings.Split(string(buf[0:rlen]), "\n")
+		s.relayCSMDatagram(buf[0:rlen])
+		s.handleCSMDatagram(buf[0:rlen])
+	}
+}
 
-	EntryLoop:
-		for _, entry := range entries {
-			var e Entry
+func (s *Session) handleCSMDatagram(data []byte) {
+	entries, rejects := parseCSMDatagram(data)
 
-			err := json.Unmarshal([]byte(entry), &e)
-			if err != nil {
-				panic(err)
-			}
+	s.mu.Lock()
+	s.csmStats.Datagrams++
+	s.csmStats.Rejected += len(rejects)
+	s.csmStats.RecentRejects = append(s.csmStats.RecentRejects, rejects...)
+	if len(s.csmStats.RecentRejects) > maxCSMRejects {
+		s.csmStats.RecentRejects = s.csmStats.RecentRejects[len(s.csmStats.RecentRejects)-maxCSMRejects:]
+	}
+	s.mu.Unlock()
 
-			// checked if permissionless
-			for _, permissionlessAction := range iamMap.SDKPermissionlessActions {
-				if strings.ToLower(permissionlessAction) == fmt.Sprintf("%s.%s", strings.ToLower(e.Service), strings.ToLower(e.Method)) {
-					continue EntryLoop
-				}
-			}
+	if s.options.Debug {
+		for _, reject := range rejects {
+			fmt.Printf("Rejected CSM entry (%s): %s\n", reject.Reason, reject.Payload)
+		}
+	}
 
-			if e.Type == "ApiCall" {
-				callLog = append(callLog, e)
-				handleLoggedCall()
+	for _, e := range entries {
+		e := e
+
+		if e.Type == "ApiCallAttempt" { // the ApiCall record follows the attempts
+			s.mu.Lock()
+			s.csmStats.Attempts++
+			if !s.isPermissionless(e.Service, e.Method) {
+				s.attemptLog = append(s.attemptLog, e)
 			}
+			s.mu.Unlock()
+			continue
 		}
+
+		if s.isPermissionless(e.Service, e.Method) {
+			s.mu.Lock()
+			s.csmStats.Permissionless++
+			s.mu.Unlock()
+			continue
+		}
+
+		if e.Timestamp == 0 { // not sent by every SDK
+			e.Timestamp = time.Now().UnixMilli()
+		}
+
+		s.mu.Lock()
+		s.csmStats.Calls++
+		s.callLog = append(s.callLog, e)
+		s.mu.Unlock()
+		s.publishCall(CallEvent{Provider: "aws", AWS: &e})
+		s.handleLoggedCall()
 	}
 }
@@ -0,0 +1,30 @@
+package iamlivecore
+
+import "testing"
+
+func FuzzParseCSMDatagram(f *testing.F) {
+	f.Add([]byte(`{"Version":1,"ClientId":"","Type":"ApiCall","Service":"S3","Api":"ListBuckets","Timestamp":1600000000000,"AttemptCount":1,"Region":"us-east-1","UserAgent":"aws-cli/2","FinalHttpStatusCode":200,"Latency":42,"MaxRetriesExceeded":0}`))
+	f.Add([]byte(`{"Version":1,"ClientId":"","Type":"ApiCallAttempt","Service":"S3","Api":"ListBuckets","Timestamp":1600000000000,"Fqdn":"s3.amazonaws.com","HttpStatusCode":503,"AwsException":"SlowDown","AttemptLatency":12}`))
+	f.Add([]byte(`{"Type":"ApiCall","Service":"SQS","Api":"SendMessage"}` + "\n"))
+	f.Add([]byte{})
+	f.Add([]byte("\x00\xffnot json"))
+	f.Add([]byte(`{"Service":"S3","Api":"ListBuckets"}`))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		entries, rejects := parseCSMDatagram(data)
+
+		for _, entry := range entries {
+			if entry.Type != "ApiCall" && entry.Type != "ApiCallAttempt" {
+				t.Errorf("entry with Type %q", entry.Type)
+			}
+			if entry.Service == "" || entry.Method == "" {
+				t.Errorf("entry without Service or Api: %+v", entry)
+			}
+		}
+		for _, reject := range rejects {
+			if len(reject.Payload) > 1024 {
+				t.Errorf("reject payload of %d bytes", len(reject.Payload))
+			}
+		}
+	})
+}
@@ -0,0 +1,122 @@
+package iamlivecore
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// csmListenAddr is a UDP host:port, or the path of a Unix datagram socket, to receive CSM datagrams on
+type csmListenAddr struct {
+	network string // udp or unixgram
+	address string
+}
+
+// getCSMListenAddrs returns the addresses of the CSMListen option, or Host and CSMPort when it is unset. Addresses
+// are host:port, [ipv6]:port, udp://host:port or unix:///path/to/socket.
+func (s *Session) getCSMListenAddrs() ([]csmListenAddr, error) {
+	if strings.TrimSpace(s.options.CSMListen) == "" {
+		return []csmListenAddr{{network: "udp", address: net.JoinHostPort(s.options.Host, strconv.Itoa(s.options.CSMPort))}}, nil
+	}
+
+	addrs := []csmListenAddr{}
+	for _, addr := range strings.Split(s.options.CSMListen, ",") {
+		addr = strings.TrimSpace(addr)
+		if addr == "" {
+			continue
+		}
+
+		switch {
+		case strings.HasPrefix(addr, "unix:") || strings.HasPrefix(addr, "unixgram:"):
+			path := strings.TrimPrefix(addr[strings.Index(addr, ":")+1:], "//")
+			if path == "" {
+				return nil, fmt.Errorf("invalid CSM listen address %s: no socket path", addr)
+			}
+			addrs = append(addrs, csmListenAddr{network: "unixgram", address: path})
+		default:
+			hostport := strings.TrimPrefix(addr, "udp://")
+			if _, _, err := net.SplitHostPort(hostport); err != nil {
+				return nil, fmt.Errorf("invalid CSM listen address %s: %v", addr, err)
+			}
+			addrs = append(addrs, csmListenAddr{network: "udp", address: hostport})
+		}
+	}
+
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no CSM listen address")
+	}
+
+	return addrs, nil
+}
+
+func listenCSM(addr csmListenAddr) (net.PacketConn, error) {
+	if addr.network == "unixgram" {
+		if info, err := os.Stat(addr.address); err == nil {
+			if info.Mode()&os.ModeSocket == 0 {
+				return nil, fmt.Errorf("%s exists and isn't a socket", addr.address)
+			}
+			os.Remove(addr.address) // left by a previous run
+		}
+	}
+
+	conn, err := net.ListenPacket(addr.network, addr.address)
+	if err != nil {
+		return nil, err
+	}
+
+	if bufferedConn, ok := conn.(interface{ SetReadBuffer(int) error }); ok {
+		if err := bufferedConn.SetReadBuffer(1048576); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	return conn, nil
+}
+
+// startCSMListeners listens on each CSM address, recording the calls received on any of them in the session
+func (s *Session) startCSMListeners() error {
+	addrs, err := s.getCSMListenAddrs()
+	if err != nil {
+		return err
+	}
+
+	for _, addr := range addrs {
+		conn, err := listenCSM(addr)
+		if err != nil {
+			s.closeCSMListeners()
+			return err
+		}
+		s.csmConns = append(s.csmConns, conn)
+		if addr.network == "unixgram" {
+			s.csmSocketPaths = append(s.csmSocketPaths, addr.address)
+		}
+	}
+
+	if err := s.openCSMRelay(); err != nil {
+		s.closeCSMListeners()
+		return err
+	}
+
+	for _, conn := range s.csmConns {
+		conn := conn
+		go func() {
+			s.listenerStopped(s.listenForEvents(conn))
+		}()
+	}
+
+	return nil
+}
+
+func (s *Session) closeCSMListeners() {
+	for _, conn := range s.csmConns {
+		conn.Close()
+	}
+	for _, path := range s.csmSocketPaths {
+		os.Remove(path)
+	}
+	s.csmConns = nil
+	s.csmSocketPaths = nil
+}
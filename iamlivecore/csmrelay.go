@@ -0,0 +1,117 @@
+package iamlivecore
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+)
+
+// csmRelay forwards the CSM datagrams a session receives to other listeners, and appends them to a buffer file
+type csmRelay struct {
+	mu      sync.Mutex
+	targets []*net.UDPConn
+	buffer  *os.File
+}
+
+func getCSMForwardTargets(targets string) []string {
+	addrs := []string{}
+	for _, addr := range strings.Split(targets, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+// openCSMRelay connects to the forward targets and opens the buffer file set in the options
+func (s *Session) openCSMRelay() error {
+	for _, addr := range getCSMForwardTargets(s.options.CSMForward) {
+		udpAddr, err := net.ResolveUDPAddr("udp", addr)
+		if err != nil {
+			s.closeCSMRelay()
+			return fmt.Errorf("invalid CSM forward target %s: %v", addr, err)
+		}
+		conn, err := net.DialUDP("udp", nil, udpAddr)
+		if err != nil {
+			s.closeCSMRelay()
+			return err
+		}
+		s.csmRelay.targets = append(s.csmRelay.targets, conn)
+	}
+
+	if s.options.CSMBufferFile != "" {
+		file, err := os.OpenFile(s.options.CSMBufferFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			s.closeCSMRelay()
+			return err
+		}
+		s.csmRelay.buffer = file
+	}
+
+	return nil
+}
+
+func (s *Session) closeCSMRelay() {
+	s.csmRelay.mu.Lock()
+	defer s.csmRelay.mu.Unlock()
+
+	for _, conn := range s.csmRelay.targets {
+		conn.Close()
+	}
+	s.csmRelay.targets = nil
+
+	if s.csmRelay.buffer != nil {
+		s.csmRelay.buffer.Close()
+		s.csmRelay.buffer = nil
+	}
+}
+
+// relayCSMDatagram sends the datagram on unchanged to each forward target, and appends it to the buffer file, one
+// line per entry as it was received
+func (s *Session) relayCSMDatagram(data []byte) {
+	s.csmRelay.mu.Lock()
+	defer s.csmRelay.mu.Unlock()
+
+	forwardErrors, bufferErrors := 0, 0
+	for _, conn := range s.csmRelay.targets {
+		if _, err := conn.Write(data); err != nil { // best effort, as for the SDKs
+			forwardErrors++
+		}
+	}
+
+	if s.csmRelay.buffer != nil {
+		line := data
+		if len(line) > 0 && line[len(line)-1] != '\n' {
+			line = append(append([]byte{}, line...), '\n')
+		}
+		if _, err := s.csmRelay.buffer.Write(line); err != nil {
+			bufferErrors++
+		}
+	}
+
+	s.mu.Lock()
+	s.csmStats.Forwarded += len(s.csmRelay.targets) - forwardErrors
+	s.csmStats.ForwardErrors += forwardErrors
+	s.csmStats.BufferErrors += bufferErrors
+	s.mu.Unlock()
+}
+
+// ReplayCSMFile records the CSM entries of a buffer file written with CSMBufferFile, as if they were received again
+func (s *Session) ReplayCSMFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 65536), 1048576) // the largest datagram
+	for scanner.Scan() {
+		s.handleCSMDatagram(scanner.Bytes())
+	}
+
+	return scanner.Err()
+}
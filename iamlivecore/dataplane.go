@@ -0,0 +1,131 @@
+package iamlivecore
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// awsDataPlaneIAMMappings covers the SigV4 signed data-plane endpoints which have no API definition, entries in the
+// mapping file take precedence
+var awsDataPlaneIAMMappings = map[string][]iamMapMethod{
+	"ExecuteAPI.Invoke": {
+		{
+			Action:      "execute-api:Invoke",
+			ArnOverride: iamMapArnOverride{Template: "arn:${Partition}:execute-api:${Region}:${Account}:${ApiId}/${Stage}/${HttpMethod}/${ResourcePath}"},
+		},
+	},
+	"ExecuteAPI.ManageConnections": {
+		{
+			Action:      "execute-api:ManageConnections",
+			ArnOverride: iamMapArnOverride{Template: "arn:${Partition}:execute-api:${Region}:${Account}:${ApiId}/${Stage}/${HttpMethod}/${ResourcePath}"},
+		},
+	},
+	"Lambda.InvokeFunctionUrl": {
+		{
+			Action:      "lambda:InvokeFunctionUrl",
+			ArnOverride: iamMapArnOverride{Template: "arn:${Partition}:lambda:${Region}:${Account}:function:*"}, // the URL ID doesn't name the function
+		},
+	},
+}
+
+var (
+	executeAPIHostRegex = regexp.MustCompile(`^([a-z0-9]+)(?:-vpce-[a-z0-9]+)?\.execute-api\.([^.]+)\.amazonaws\.com$`) // abc123.execute-api.us-east-1.amazonaws.com, or abc123-vpce-0123.execute-api... for private APIs
+	lambdaURLHostRegex  = regexp.MustCompile(`^([a-z0-9]+)\.lambda-url\.([^.]+)\.on\.aws$`)                             // urlid.lambda-url.us-east-1.on.aws
+)
+
+func (s *Session) addDataPlaneIAMMappings() {
+	if s.iamMap.SDKMethodIAMMappings == nil {
+		s.iamMap.SDKMethodIAMMappings = map[string][]iamMapMethod{}
+	}
+
+	for sdkCall, mappings := range awsDataPlaneIAMMappings {
+		if _, ok := s.iamMap.SDKMethodIAMMappings[sdkCall]; !ok {
+			s.iamMap.SDKMethodIAMMappings[sdkCall] = append([]iamMapMethod{}, mappings...) // overlays may append to these
+		}
+	}
+}
+
+func isAWSDataPlaneHost(hostname string) bool {
+	return lambdaURLHostRegex.MatchString(hostname)
+}
+
+// getAWSDataPlaneEntry returns the call for a request to API Gateway or a Lambda function URL
+func getAWSDataPlaneEntry(req *http.Request, host string, respCode int) (Entry, bool) {
+	accessKey, sessionToken := getAWSCallCredentials(req)
+	if accessKey == "" { // unsigned, so not authorized by IAM
+		return Entry{}, false
+	}
+
+	entry := Entry{
+		Type:                "ProxyCall",
+		Timestamp:           time.Now().UnixMilli(),
+		Parameters:          map[string][]string{},
+		FinalHTTPStatusCode: respCode,
+		AccessKey:           accessKey,
+		SessionToken:        sessionToken,
+		Host:                host,
+	}
+
+	if matches := executeAPIHostRegex.FindStringSubmatch(host); len(matches) == 3 {
+		pathParts := strings.SplitN(strings.TrimPrefix(req.URL.Path, "/"), "/", 2) // /{stage}/{path}
+		if pathParts[0] == "" {
+			return Entry{}, false
+		}
+		resourcePath := ""
+		if len(pathParts) == 2 {
+			resourcePath = pathParts[1]
+		}
+
+		entry.Region = matches[2]
+		entry.Service = "ExecuteAPI"
+		entry.Method = "Invoke"
+		if strings.HasPrefix(resourcePath, "@connections") { // WebSocket APIs
+			entry.Method = "ManageConnections"
+		}
+		entry.URIParameters = map[string]string{
+			"ApiId":        matches[1],
+			"Stage":        pathParts[0],
+			"HttpMethod":   req.Method,
+			"ResourcePath": resourcePath,
+		}
+
+		return entry, true
+	}
+
+	if matches := lambdaURLHostRegex.FindStringSubmatch(host); len(matches) == 3 {
+		entry.Region = matches[2]
+		entry.Service = "Lambda"
+		entry.Method = "InvokeFunctionUrl"
+		entry.URIParameters = map[string]string{
+			"UrlId": matches[1],
+		}
+
+		return entry, true
+	}
+
+	return Entry{}, false
+}
+
+// getAWSCallCredentials determines the access key and session token the request was signed with
+func getAWSCallCredentials(req *http.Request) (string, string) {
+	accessKey := ""
+	authHeader := req.Header.Get("Authorization")
+	credOffset := strings.Index(authHeader, "Credential=")
+	if credOffset > 0 {
+		endOfKey := strings.Index(authHeader[credOffset:], "/")
+		if endOfKey > 0 {
+			accessKey = authHeader[credOffset+len("Credential=") : credOffset+endOfKey]
+		}
+	} else if credential := req.URL.Query().Get("X-Amz-Credential"); credential != "" { // presigned
+		accessKey = strings.Split(credential, "/")[0]
+	}
+
+	sessionToken := req.Header.Get("X-Amz-Security-Token")
+	if sessionToken == "" {
+		sessionToken = req.URL.Query().Get("X-Amz-Security-Token")
+	}
+
+	return accessKey, sessionToken
+}
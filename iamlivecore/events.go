@@ -0,0 +1,178 @@
+package iamlivecore
+
+import (
+	"bytes"
+	"sync"
+)
+
+// Event is a CallEvent, PermissionEvent or PolicyEvent
+type Event interface {
+	isEvent()
+}
+
+// CallEvent is a call captured by a session, with one of AWS, Azure or GCP set by provider
+type CallEvent struct {
+	Provider string
+	AWS      *Entry      // CSM or proxy call
+	Azure    *AzureEntry // proxy request
+	GCP      string      // method ID, such as compute.instances.get
+}
+
+// PermissionEvent is an action, with the resource it applies to, the policy didn't need before
+type PermissionEvent struct {
+	Provider string
+	Action   string
+	Resource string // empty for Azure and GCP
+}
+
+// PolicyEvent is the policy of a session after it changed
+type PolicyEvent struct {
+	Policy   Policy
+	Document []byte // as PolicyDocument
+}
+
+func (CallEvent) isEvent()       {}
+func (PermissionEvent) isEvent() {}
+func (PolicyEvent) isEvent()     {}
+
+// eventSubscribers holds the handlers of a session and what they have been told of the policy
+type eventSubscribers struct {
+	mu       sync.Mutex
+	handlers map[int]func(Event)
+	nextID   int
+
+	publishMu       sync.Mutex // keeps events in order, held while handlers are called
+	stateMu         sync.Mutex // guards what the handlers have been told of, never held while handlers are called
+	lastDocument    []byte
+	seenPermissions map[string]bool
+}
+
+// Subscribe calls handler with each event of the session, until the returned function is called. Handlers are called
+// in turn from the goroutine capturing the call, so should return quickly. They may call the methods of the session,
+// such as Reset or Flush, but mustn't wait on further calls being captured, as their events wait for the handlers.
+func (s *Session) Subscribe(handler func(Event)) (unsubscribe func()) {
+	s.subscribers.mu.Lock()
+	defer s.subscribers.mu.Unlock()
+
+	if s.subscribers.handlers == nil {
+		s.subscribers.handlers = map[int]func(Event){}
+	}
+	id := s.subscribers.nextID
+	s.subscribers.nextID++
+	s.subscribers.handlers[id] = handler
+
+	return func() {
+		s.subscribers.mu.Lock()
+		defer s.subscribers.mu.Unlock()
+
+		delete(s.subscribers.handlers, id)
+	}
+}
+
+func (s *Session) getEventHandlers() []func(Event) {
+	s.subscribers.mu.Lock()
+	defer s.subscribers.mu.Unlock()
+
+	handlers := []func(Event){}
+	for id := 0; id < s.subscribers.nextID; id++ { // in the order subscribed
+		if handler, ok := s.subscribers.handlers[id]; ok {
+			handlers = append(handlers, handler)
+		}
+	}
+	return handlers
+}
+
+// publishCall tells the handlers of a captured call, then of the permissions and policy it changed
+func (s *Session) publishCall(event CallEvent) {
+	handlers := s.getEventHandlers()
+	if len(handlers) == 0 {
+		return
+	}
+
+	s.subscribers.publishMu.Lock()
+	defer s.subscribers.publishMu.Unlock()
+
+	for _, handler := range handlers {
+		handler(event)
+	}
+
+	for _, policyEvent := range s.getPolicyEvents() {
+		for _, handler := range handlers {
+			handler(policyEvent)
+		}
+	}
+}
+
+// getPolicyEvents returns the permissions the handlers weren't yet told of, followed by the policy, if it changed
+func (s *Session) getPolicyEvents() []Event {
+	s.subscribers.stateMu.Lock()
+	defer s.subscribers.stateMu.Unlock()
+
+	doc := s.PolicyDocument()
+	if bytes.Equal(doc, s.subscribers.lastDocument) {
+		return nil
+	}
+	s.subscribers.lastDocument = doc
+
+	policy := s.Policy()
+	events := []Event{}
+	if s.subscribers.seenPermissions == nil {
+		s.subscribers.seenPermissions = map[string]bool{}
+	}
+	for _, permission := range getPolicyPermissions(policy) {
+		key := permission.Provider + "\x00" + permission.Action + "\x00" + permission.Resource
+		if s.subscribers.seenPermissions[key] {
+			continue
+		}
+		s.subscribers.seenPermissions[key] = true
+
+		events = append(events, permission)
+	}
+
+	return append(events, PolicyEvent{
+		Policy:   policy,
+		Document: doc,
+	})
+}
+
+// resetEvents forgets the permissions the handlers were told of, so they are told again as calls are captured
+func (s *Session) resetEvents() {
+	s.subscribers.stateMu.Lock()
+	defer s.subscribers.stateMu.Unlock()
+
+	s.subscribers.lastDocument = nil
+	s.subscribers.seenPermissions = nil
+}
+
+// getPolicyPermissions returns each action of the policy with each resource it applies to
+func getPolicyPermissions(policy Policy) []PermissionEvent {
+	permissions := []PermissionEvent{}
+
+	if policy.AWS != nil {
+		for _, statement := range policy.AWS.Statement {
+			resources := []string{}
+			switch resource := statement.Resource.(type) {
+			case string:
+				resources = append(resources, resource)
+			case []string:
+				resources = append(resources, resource...)
+			}
+
+			for _, action := range statement.Action {
+				for _, resource := range resources {
+					permissions = append(permissions, PermissionEvent{Provider: "aws", Action: action, Resource: resource})
+				}
+			}
+		}
+	}
+	if policy.Azure != nil {
+		for _, action := range append(append([]string{}, policy.Azure.Actions...), policy.Azure.DataActions...) {
+			permissions = append(permissions, PermissionEvent{Provider: "azure", Action: action})
+		}
+	}
+	for _, permission := range policy.GCP {
+		permissions = append(permissions, PermissionEvent{Provider: "gcp", Action: permission})
+	}
+
+	return permissions
+}
@@ -0,0 +1,49 @@
+package iamlivecore
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHandlerMayResetSession(t *testing.T) {
+	s, err := NewSession(Options{Mode: "proxy", Provider: "gcp"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events := []Event{}
+	s.Subscribe(func(event Event) {
+		events = append(events, event)
+		if _, ok := event.(PolicyEvent); ok {
+			s.Reset()
+		}
+	})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 2; i++ {
+			s.mu.Lock()
+			s.gcpCallLog = append(s.gcpCallLog, "compute.instances.get")
+			s.mu.Unlock()
+			s.publishCall(CallEvent{Provider: "gcp", GCP: "compute.instances.get"})
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("publishing deadlocked on a handler calling Reset")
+	}
+
+	// the reset policy is told of again
+	permissions := 0
+	for _, event := range events {
+		if _, ok := event.(PermissionEvent); ok {
+			permissions++
+		}
+	}
+	if permissions != 2 {
+		t.Errorf("got %d permission events from %v, want 2", permissions, events)
+	}
+}
@@ -0,0 +1,196 @@
+package iamlivecore
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// HostRule decides whether traffic to a host is intercepted and which provider handler receives it
+type HostRule struct {
+	Host      string `json:"host"`       // glob, e.g. *.amazonaws.com
+	HostRegex string `json:"host_regex"` // alternative to Host
+	Port      string `json:"port"`       // comma-separated, empty for any
+	Action    string `json:"action"`     // mitm or passthrough
+	Provider  string `json:"provider"`   // aws, azure or gcp
+	Endpoint  string `json:"endpoint"`   // the public hostname the provider handler should treat the request as
+
+	hostRegexp *regexp.Regexp
+}
+
+type hostRulesFile struct {
+	Rules []HostRule `json:"rules"`
+}
+
+var defaultHostRules = []HostRule{
+	{Host: "*.amazonaws.com", Action: "mitm", Provider: "aws"},
+	{Host: "*.amazonaws.com.cn", Action: "mitm", Provider: "aws"},
+	{Host: "*.lambda-url.*.on.aws", Action: "mitm", Provider: "aws"},
+	{Host: "management.azure.com", Action: "mitm", Provider: "azure"},
+	{Host: "management.core.windows.net", Action: "mitm", Provider: "azure"},
+	{Host: "*.googleapis.com", Action: "mitm", Provider: "gcp"},
+}
+
+func (rule *HostRule) compile() error {
+	if rule.Host == "" && rule.HostRegex == "" {
+		return fmt.Errorf("host rule must specify host or host_regex")
+	}
+
+	if rule.Action == "" {
+		rule.Action = "mitm"
+	}
+	if rule.Action != "mitm" && rule.Action != "passthrough" {
+		return fmt.Errorf("unknown host rule action %q", rule.Action)
+	}
+
+	if rule.Provider != "" && rule.Provider != "aws" && rule.Provider != "azure" && rule.Provider != "gcp" {
+		return fmt.Errorf("unknown host rule provider %q", rule.Provider)
+	}
+
+	if rule.Host != "" {
+		if _, err := path.Match(rule.Host, ""); err != nil {
+			return fmt.Errorf("invalid host glob %q: %v", rule.Host, err)
+		}
+	}
+
+	if rule.HostRegex != "" {
+		re, err := regexp.Compile(rule.HostRegex)
+		if err != nil {
+			return fmt.Errorf("invalid host_regex %q: %v", rule.HostRegex, err)
+		}
+		rule.hostRegexp = re
+	}
+
+	return nil
+}
+
+func (rule *HostRule) matches(hostname, port string) bool {
+	if rule.Port != "" {
+		portMatch := false
+		for _, rulePort := range strings.Split(rule.Port, ",") {
+			rulePort = strings.TrimSpace(rulePort)
+			if rulePort == "*" || rulePort == port {
+				portMatch = true
+				break
+			}
+		}
+		if !portMatch {
+			return false
+		}
+	}
+
+	if rule.Host != "" {
+		matched, _ := path.Match(strings.ToLower(rule.Host), hostname)
+		return matched
+	}
+
+	return rule.hostRegexp.MatchString(hostname)
+}
+
+func (s *Session) loadHostRules() error {
+	s.hostRules = []HostRule{}
+
+	if s.options.HostRules != "" {
+		data, err := os.ReadFile(s.options.HostRules)
+		if err != nil {
+			return err
+		}
+
+		var rulesFile hostRulesFile
+		err = json.Unmarshal(data, &rulesFile)
+		if err != nil {
+			return fmt.Errorf("error parsing host rules file %s: %v", s.options.HostRules, err)
+		}
+
+		s.hostRules = append(s.hostRules, rulesFile.Rules...)
+	}
+
+	s.hostRules = append(s.hostRules, defaultHostRules...) // user rules take precedence
+
+	for i := range s.hostRules {
+		if err := s.hostRules[i].compile(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func splitHostPort(hostport, scheme string) (string, string) {
+	hostname, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		hostname = hostport
+		port = ""
+	}
+
+	if port == "" {
+		if scheme == "http" {
+			port = "80"
+		} else {
+			port = "443"
+		}
+	}
+
+	return strings.ToLower(strings.TrimSuffix(hostname, ".")), port
+}
+
+// matchHostRule returns the first rule matching the host, or nil when there is none
+func (s *Session) matchHostRule(hostport, scheme string) *HostRule {
+	hostname, port := splitHostPort(hostport, scheme)
+
+	for i := range s.hostRules {
+		if s.hostRules[i].matches(hostname, port) {
+			return &s.hostRules[i]
+		}
+	}
+
+	return nil
+}
+
+func getRequestScheme(req *http.Request) string {
+	if req.URL.Scheme != "" {
+		return req.URL.Scheme
+	}
+	if req.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// getProviderRequest returns a shallow copy of the request carrying the hostname the provider handler expects
+func getProviderRequest(req *http.Request, rule *HostRule) *http.Request {
+	hostname, _ := splitHostPort(req.Host, getRequestScheme(req))
+	if rule.Endpoint != "" {
+		hostname = rule.Endpoint
+	} else if rule.Provider == "aws" && !isAWSEndpoint(hostname) {
+		hostname = getAWSEndpointFromCredentialScope(req, hostname)
+	}
+
+	providerReq := *req
+	providerReq.Host = hostname
+
+	return &providerReq
+}
+
+func isAWSEndpoint(hostname string) bool {
+	return strings.HasSuffix(hostname, ".amazonaws.com") || strings.HasSuffix(hostname, ".amazonaws.com.cn") || isAWSDataPlaneHost(hostname)
+}
+
+// getAWSEndpointFromCredentialScope derives a public endpoint for emulators and private endpoints from the SigV4 scope
+func getAWSEndpointFromCredentialScope(req *http.Request, fallback string) string {
+	region, service := getSigV4CredentialScope(req)
+	if region == "" || service == "" {
+		return fallback
+	}
+
+	if strings.HasPrefix(region, "cn-") {
+		return fmt.Sprintf("%s.%s.amazonaws.com.cn", service, region)
+	}
+
+	return fmt.Sprintf("%s.%s.amazonaws.com", service, region)
+}
@@ -0,0 +1,189 @@
+package iamlivecore
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// hybridCorrelationWindow is how long, in milliseconds, a proxied request may be logged before the start or after the
+// end of the CSM call it was made for
+const hybridCorrelationWindow = 5000
+
+// csmOnlySid marks the statement for calls reported by CSM which weren't seen by the proxy, so have no resources
+const csmOnlySid = "CSMOnly"
+
+var hybridServiceNameRegex = regexp.MustCompile(`\W+`)
+
+func normalizeHybridServiceName(service string) string {
+	return strings.ToLower(hybridServiceNameRegex.ReplaceAllString(service, ""))
+}
+
+// getHybridServiceNames maps each name CSM may report for a service, normalized, to the name the proxy logs calls to
+// it under. CSM reports the service ID, such as "Elastic Load Balancing v2", or the SDK name before or after aliasing,
+// such as ELBv2.
+func (s *Session) getHybridServiceNames() map[string]string {
+	s.hybridServiceNamesOnce.Do(func() {
+		s.hybridServiceNames = map[string]string{}
+		for _, serviceDefinition := range serviceDefinitions {
+			service := s.getAWSServiceName(serviceDefinition.Metadata)
+			for _, name := range []string{serviceDefinition.Metadata.ServiceID, getSDKServiceName(serviceDefinition.Metadata)} {
+				if name != "" {
+					s.hybridServiceNames[normalizeHybridServiceName(name)] = service
+				}
+			}
+		}
+		for _, serviceDefinition := range serviceDefinitions { // the proxy names always stand for themselves
+			service := s.getAWSServiceName(serviceDefinition.Metadata)
+			s.hybridServiceNames[normalizeHybridServiceName(service)] = service
+		}
+	})
+
+	return s.hybridServiceNames
+}
+
+// getHybridCallKey returns the service and method of a call, matching between the names CSM reports and those taken
+// from the API definitions by the proxy
+func (s *Session) getHybridCallKey(entry Entry) string {
+	service := normalizeHybridServiceName(entry.Service)
+	if name, ok := s.getHybridServiceNames()[service]; ok {
+		service = normalizeHybridServiceName(name)
+	}
+
+	return service + "." + strings.ToLower(entry.Method)
+}
+
+// correlateHybridCalls pairs each CSM call with the proxied requests for the same method made while it ran, one for
+// each attempt, returning the proxied calls and the CSM calls the proxy didn't see
+func (s *Session) correlateHybridCalls(callLog []Entry) ([]Entry, []Entry) {
+	proxyCalls := []Entry{}
+	csmOnlyCalls := []Entry{}
+
+	proxyCallsByKey := map[string][]int{}
+	for _, entry := range callLog {
+		if entry.Type == "ProxyCall" {
+			key := s.getHybridCallKey(entry)
+			proxyCallsByKey[key] = append(proxyCallsByKey[key], len(proxyCalls))
+			proxyCalls = append(proxyCalls, entry)
+		}
+	}
+
+	matched := make([]bool, len(proxyCalls))
+	for _, entry := range callLog {
+		if entry.Type != "ApiCall" {
+			continue
+		}
+
+		earliest := entry.Timestamp - hybridCorrelationWindow
+		latest := entry.Timestamp + int64(entry.Latency) + hybridCorrelationWindow
+
+		found := 0
+		for found < max(entry.AttemptCount, 1) {
+			best := -1
+			var bestDistance int64
+			for _, i := range proxyCallsByKey[s.getHybridCallKey(entry)] {
+				if matched[i] || proxyCalls[i].Timestamp < earliest || proxyCalls[i].Timestamp > latest {
+					continue
+				}
+
+				distance := proxyCalls[i].Timestamp - entry.Timestamp
+				if distance < 0 {
+					distance = -distance
+				}
+				if best == -1 || distance < bestDistance {
+					best, bestDistance = i, distance
+				}
+			}
+			if best == -1 {
+				break
+			}
+
+			matched[best] = true
+			found++
+		}
+
+		if found == 0 {
+			csmOnlyCalls = append(csmOnlyCalls, entry)
+		}
+	}
+
+	return proxyCalls, csmOnlyCalls
+}
+
+// getCSMOnlyStatement returns the action-only statement for the CSM calls the proxy didn't see, leaving out actions
+// the policy already allows on all resources
+func (s *Session) getCSMOnlyStatement(policy IAMPolicy, csmOnlyCalls []Entry) (Statement, bool) {
+	allowed := map[string]bool{}
+	for _, statement := range policy.Statement {
+		if resource, ok := statement.Resource.(string); ok && resource == "*" {
+			for _, action := range statement.Action {
+				allowed[action] = true
+			}
+		}
+	}
+
+	actions := []string{}
+	for _, entry := range csmOnlyCalls {
+		if s.options.FailsOnly && (entry.FinalHTTPStatusCode >= 200 && entry.FinalHTTPStatusCode <= 299) {
+			continue
+		}
+
+		for _, action := range getDependantActions(s.getActions(entry.Service, entry.Method)) {
+			if !allowed[action] {
+				actions = append(actions, action)
+			}
+		}
+	}
+	if len(actions) == 0 {
+		return Statement{}, false
+	}
+
+	actions = uniqueSlice(actions)
+	if s.options.SortAlphabetical {
+		sort.Strings(actions)
+	}
+
+	return Statement{
+		Sid:      csmOnlySid,
+		Effect:   "Allow",
+		Resource: "*",
+		Action:   actions,
+	}, true
+}
+
+// getHybridSummary returns where the AWS calls were seen, as shown beneath the policy in the terminal
+func (s *Session) getHybridSummary() string {
+	callLog, _, _, _ := s.getCallLogs()
+	proxyCalls, csmOnlyCalls := s.correlateHybridCalls(callLog)
+
+	csmCalls := 0
+	for _, entry := range callLog {
+		if entry.Type == "ApiCall" {
+			csmCalls++
+		}
+	}
+
+	lines := []string{fmt.Sprintf("Sources: %d proxied, %d reported by CSM, %d by CSM only", len(proxyCalls), csmCalls, len(csmOnlyCalls))}
+
+	clients := map[string][]string{} // the CSM only calls of each client, which likely bypasses the proxy
+	for _, entry := range csmOnlyCalls {
+		client := strings.TrimSpace(entry.ClientID + " " + entry.UserAgent)
+		if client == "" {
+			client = "(no client ID)"
+		}
+		clients[client] = uniqueSlice(append(clients[client], entry.Service+"."+entry.Method))
+	}
+
+	names := []string{}
+	for client := range clients {
+		names = append(names, client)
+	}
+	sort.Strings(names)
+	for _, client := range names {
+		sort.Strings(clients[client])
+		lines = append(lines, fmt.Sprintf("  CSM only  %s: %s", client, strings.Join(clients[client], ", ")))
+	}
+
+	return strings.Join(lines, "\n")
+}
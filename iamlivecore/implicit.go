@@ -0,0 +1,298 @@
+package iamlivecore
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// ImplicitPermissionRule grants further actions when a call carries a parameter, such as the role passed to what the
+// call creates or the KMS key used to encrypt what it writes
+type ImplicitPermissionRule struct {
+	Action    string   `json:"action"`     // the IAM action called, e.g. ec2:RunInstances
+	Methods   []string `json:"methods"`    // alternatively, the SDK methods called, e.g. S3.PutObject
+	Parameter string   `json:"parameter"`  // the flattened parameter name, Map.Key for an entry of a map parameter
+	Match     string   `json:"match"`      // regular expression the value must match, empty for any value
+	Grant     []string `json:"grant"`      // the actions granted
+	Resource  string   `json:"resource"`   // template for the resource, ${Value} being the parameter value
+	ValueType string   `json:"value_type"` // kms-key to turn key IDs and aliases into key ARNs
+
+	matchRegexp *regexp.Regexp
+}
+
+// ActionExclusionRule leaves a mapped action out of a call's statements depending on the host the call was sent to,
+// such as where an SDK method maps to the actions of both S3 and S3 Express
+type ActionExclusionRule struct {
+	Action     string `json:"action"`      // the mapped action, a trailing * matching any, e.g. s3express:*
+	Host       string `json:"host"`        // regular expression the host must match, empty for any host
+	ExceptHost string `json:"except_host"` // regular expression the host must not match, empty for none
+	Shared     bool   `json:"shared"`      // only when the method maps to more than one action
+
+	hostRegexp       *regexp.Regexp
+	exceptHostRegexp *regexp.Regexp
+}
+
+type implicitPermissionRulesFile struct {
+	Rules      []ImplicitPermissionRule `json:"rules"`
+	Exclusions []ActionExclusionRule    `json:"exclusions"`
+}
+
+var kmsEncryptActions = []string{"kms:GenerateDataKey", "kms:Decrypt"}
+var kmsGrantActions = []string{"kms:CreateGrant", "kms:DescribeKey", "kms:GenerateDataKeyWithoutPlaintext", "kms:Decrypt"}
+
+const anyRoleResource = "arn:${Partition}:iam::${Account}:role/*"
+
+// Doc: https://docs.aws.amazon.com/kms/latest/developerguide/service-integration.html
+// Doc: https://docs.aws.amazon.com/IAM/latest/UserGuide/id_roles_use_passrole.html
+var defaultImplicitPermissionRules = []ImplicitPermissionRule{
+	{Action: "s3:PutObject", Parameter: "SSEKMSKeyId", Grant: []string{"kms:GenerateDataKey"}, ValueType: "kms-key"},
+	{Methods: []string{"S3.CreateMultipartUpload", "S3.CopyObject"}, Parameter: "SSEKMSKeyId", Grant: kmsEncryptActions, ValueType: "kms-key"},
+	{Methods: []string{"EC2.CreateVolume", "EC2.CopySnapshot", "EC2.CopyImage"}, Parameter: "KmsKeyId", Grant: kmsGrantActions, ValueType: "kms-key"},
+	{Methods: []string{"EC2.RunInstances", "EC2.CreateLaunchTemplate", "EC2.CreateLaunchTemplateVersion"}, Parameter: "BlockDeviceMappings[].Ebs.KmsKeyId", Grant: kmsGrantActions, ValueType: "kms-key"},
+	{Methods: []string{"EC2.CreateLaunchTemplate", "EC2.CreateLaunchTemplateVersion"}, Parameter: "LaunchTemplateData.BlockDeviceMappings[].Ebs.KmsKeyId", Grant: kmsGrantActions, ValueType: "kms-key"},
+	{Methods: []string{"SQS.CreateQueue", "SQS.SetQueueAttributes"}, Parameter: "Attributes.KmsMasterKeyId", Grant: kmsEncryptActions, ValueType: "kms-key"},
+	{Methods: []string{"SNS.CreateTopic", "SNS.SetTopicAttributes"}, Parameter: "Attributes.KmsMasterKeyId", Grant: kmsEncryptActions, ValueType: "kms-key"},
+	{Methods: []string{"DynamoDB.CreateTable", "DynamoDB.UpdateTable"}, Parameter: "SSESpecification.KMSMasterKeyId", Grant: []string{"kms:CreateGrant", "kms:DescribeKey", "kms:Decrypt"}, ValueType: "kms-key"},
+
+	// the instance profile doesn't name its role
+	{Action: "ec2:RunInstances", Parameter: "IamInstanceProfile.Arn", Grant: []string{"iam:PassRole"}, Resource: anyRoleResource},
+	{Action: "ec2:RunInstances", Parameter: "IamInstanceProfile.Name", Grant: []string{"iam:PassRole"}, Resource: anyRoleResource},
+	{Action: "ec2:AssociateIamInstanceProfile", Parameter: "IamInstanceProfile.Arn", Grant: []string{"iam:PassRole"}, Resource: anyRoleResource},
+	{Action: "ec2:AssociateIamInstanceProfile", Parameter: "IamInstanceProfile.Name", Grant: []string{"iam:PassRole"}, Resource: anyRoleResource},
+	{Action: "ec2:ReplaceIamInstanceProfileAssociation", Parameter: "IamInstanceProfile.Arn", Grant: []string{"iam:PassRole"}, Resource: anyRoleResource},
+	{Action: "ec2:ReplaceIamInstanceProfileAssociation", Parameter: "IamInstanceProfile.Name", Grant: []string{"iam:PassRole"}, Resource: anyRoleResource},
+	{Action: "ecs:RegisterTaskDefinition", Parameter: "taskRoleArn", Grant: []string{"iam:PassRole"}},
+	{Action: "ecs:RegisterTaskDefinition", Parameter: "executionRoleArn", Grant: []string{"iam:PassRole"}},
+	{Action: "lambda:CreateFunction", Parameter: "Role", Grant: []string{"iam:PassRole"}},
+	{Action: "lambda:UpdateFunctionConfiguration", Parameter: "Role", Grant: []string{"iam:PassRole"}},
+}
+
+// Doc: https://docs.aws.amazon.com/AmazonS3/latest/userguide/s3-express-security-iam.html
+var defaultActionExclusionRules = []ActionExclusionRule{
+	{Action: "s3express:*", ExceptHost: `^s3express-control\.`, Shared: true},
+	{Action: "s3:*", Host: `^s3express-control\.`, Shared: true},
+	{Action: "s3:*", Host: `\.s3express-`}, // Zonal API actions
+}
+
+func (rule *ImplicitPermissionRule) compile() error {
+	if rule.Action == "" && len(rule.Methods) == 0 {
+		return fmt.Errorf("implicit permission rule must specify action or methods")
+	}
+	if rule.Parameter == "" {
+		return fmt.Errorf("implicit permission rule for %s%s must specify a parameter", rule.Action, strings.Join(rule.Methods, ","))
+	}
+	if len(rule.Grant) == 0 {
+		return fmt.Errorf("implicit permission rule for %s%s must grant at least one action", rule.Action, strings.Join(rule.Methods, ","))
+	}
+
+	if rule.ValueType != "" && rule.ValueType != "kms-key" {
+		return fmt.Errorf("unknown implicit permission rule value_type %q", rule.ValueType)
+	}
+
+	if rule.Resource == "" {
+		rule.Resource = "${Value}"
+	}
+
+	if rule.Match != "" {
+		re, err := regexp.Compile(rule.Match)
+		if err != nil {
+			return fmt.Errorf("invalid match %q: %v", rule.Match, err)
+		}
+		rule.matchRegexp = re
+	}
+
+	return nil
+}
+
+func (rule *ActionExclusionRule) compile() error {
+	if rule.Action == "" {
+		return fmt.Errorf("action exclusion rule must specify an action")
+	}
+
+	var err error
+	if rule.Host != "" {
+		if rule.hostRegexp, err = regexp.Compile(rule.Host); err != nil {
+			return fmt.Errorf("invalid host %q: %v", rule.Host, err)
+		}
+	}
+	if rule.ExceptHost != "" {
+		if rule.exceptHostRegexp, err = regexp.Compile(rule.ExceptHost); err != nil {
+			return fmt.Errorf("invalid except_host %q: %v", rule.ExceptHost, err)
+		}
+	}
+
+	return nil
+}
+
+func (s *Session) loadImplicitPermissionRules() error {
+	s.implicitPermissionRules = []ImplicitPermissionRule{}
+	s.actionExclusionRules = []ActionExclusionRule{}
+
+	if s.options.ImplicitRules != "" {
+		data, err := os.ReadFile(s.options.ImplicitRules)
+		if err != nil {
+			return err
+		}
+
+		var rulesFile implicitPermissionRulesFile
+		err = json.Unmarshal(data, &rulesFile)
+		if err != nil {
+			return fmt.Errorf("error parsing implicit permission rules file %s: %v", s.options.ImplicitRules, err)
+		}
+
+		s.implicitPermissionRules = append(s.implicitPermissionRules, rulesFile.Rules...)
+		s.actionExclusionRules = append(s.actionExclusionRules, rulesFile.Exclusions...)
+	}
+
+	s.implicitPermissionRules = append(s.implicitPermissionRules, defaultImplicitPermissionRules...)
+	s.actionExclusionRules = append(s.actionExclusionRules, defaultActionExclusionRules...)
+
+	for i := range s.implicitPermissionRules {
+		if err := s.implicitPermissionRules[i].compile(); err != nil {
+			return err
+		}
+	}
+	for i := range s.actionExclusionRules {
+		if err := s.actionExclusionRules[i].compile(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// getParameterValues returns the values of a flattened parameter, pairing the key and value lists of query protocol
+// maps where this is unambiguous
+func getParameterValues(params map[string][]string, name string) []string {
+	if values, ok := params[name]; ok {
+		return values
+	}
+
+	separator := strings.LastIndex(name, ".")
+	if separator == -1 {
+		return nil
+	}
+	mapName, key := name[:separator], name[separator+1:]
+
+	for _, entryName := range []string{mapName + ".entry[]", mapName + "[]"} { // Attributes.entry.1.key, Attribute.1.Name
+		for _, names := range [][2]string{{".key", ".value"}, {".Name", ".Value"}} {
+			keys := params[entryName+names[0]]
+			values := params[entryName+names[1]]
+			if len(keys) == 1 && len(values) == 1 && keys[0] == key {
+				return values
+			}
+		}
+	}
+
+	return nil
+}
+
+// getKMSKeyResourceValue turns a key ID, alias or ARN into the key the permission is evaluated against, which for
+// aliases is any key
+func getKMSKeyResourceValue(value string) string {
+	if strings.HasPrefix(value, "arn:") {
+		if aliasOffset := strings.Index(value, ":alias/"); aliasOffset > -1 {
+			return value[:aliasOffset] + ":key/*"
+		}
+		return value
+	}
+	if strings.HasPrefix(value, "alias/") {
+		return "arn:${Partition}:kms:${Region}:${Account}:key/*"
+	}
+	return "arn:${Partition}:kms:${Region}:${Account}:key/" + value
+}
+
+func (rule *ImplicitPermissionRule) matchesCall(call Entry, actions []string) bool {
+	if rule.Action != "" {
+		for _, action := range actions {
+			if strings.ToLower(action) == strings.ToLower(rule.Action) {
+				return true
+			}
+		}
+	}
+
+	lowerPriv := strings.ToLower(call.Service + "." + call.Method)
+	for _, method := range rule.Methods {
+		if strings.ToLower(method) == lowerPriv {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (rule *ActionExclusionRule) matchesAction(action string) bool {
+	if strings.HasSuffix(rule.Action, "*") {
+		return strings.HasPrefix(strings.ToLower(action), strings.ToLower(strings.TrimSuffix(rule.Action, "*")))
+	}
+	return strings.ToLower(action) == strings.ToLower(rule.Action)
+}
+
+// isActionExcluded returns whether a mapped action is left out of the statements for a call, shared being whether
+// the method maps to more than one action
+func (s *Session) isActionExcluded(call Entry, action string, shared bool) bool {
+	for _, rule := range s.actionExclusionRules {
+		if rule.Shared && !shared {
+			continue
+		}
+		if !rule.matchesAction(action) {
+			continue
+		}
+		if rule.hostRegexp != nil && !rule.hostRegexp.MatchString(call.Host) {
+			continue
+		}
+		if rule.exceptHostRegexp != nil && rule.exceptHostRegexp.MatchString(call.Host) {
+			continue
+		}
+		return true
+	}
+
+	return false
+}
+
+// getImplicitStatementsForProxyCall returns the statements for permissions a call needs beyond its own actions
+func (s *Session) getImplicitStatementsForProxyCall(call Entry) (statements []Statement) {
+	actions := s.getActions(call.Service, call.Method)
+
+	for _, rule := range s.implicitPermissionRules {
+		if !rule.matchesCall(call, actions) {
+			continue
+		}
+
+		values := getParameterValues(call.Parameters, rule.Parameter)
+		if uriValue, ok := call.URIParameters[rule.Parameter]; ok {
+			values = append(values, uriValue)
+		}
+
+		resources := newUniqueStringList()
+		for _, value := range values {
+			if value == "" || (rule.matchRegexp != nil && !rule.matchRegexp.MatchString(value)) {
+				continue
+			}
+			if rule.ValueType == "kms-key" {
+				value = getKMSKeyResourceValue(value)
+			}
+
+			resource := strings.ReplaceAll(rule.Resource, "${Value}", value)
+
+			_, subbedArns := s.subARNParameters(resource, call, false)
+			for _, subbedArn := range subbedArns {
+				resources.add(subbedArn)
+			}
+		}
+
+		if len(resources.list) == 0 {
+			continue
+		}
+
+		statements = append(statements, Statement{
+			Effect:   "Allow",
+			Resource: resources.list,
+			Action:   append([]string{}, rule.Grant...),
+		})
+	}
+
+	return statements
+}
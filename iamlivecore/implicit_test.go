@@ -0,0 +1,32 @@
+package iamlivecore
+
+import "testing"
+
+func TestIsActionExcluded(t *testing.T) {
+	s := &Session{}
+	if err := s.loadImplicitPermissionRules(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		host   string
+		action string
+		shared bool
+		want   bool
+	}{
+		{"s3.us-east-1.amazonaws.com", "s3:CreateBucket", true, false},
+		{"s3.us-east-1.amazonaws.com", "s3express:CreateBucket", true, true},
+		{"s3express-control.us-east-1.amazonaws.com", "s3:CreateBucket", true, true},
+		{"s3express-control.us-east-1.amazonaws.com", "s3express:CreateBucket", true, false},
+		{"s3express-control.us-east-1.amazonaws.com", "s3:ListAllMyBuckets", false, false},
+		{"bucket--use1-az4--x-s3.s3express-use1-az4.us-east-1.amazonaws.com", "s3:GetObject", false, true},
+		{"bucket--use1-az4--x-s3.s3express-use1-az4.us-east-1.amazonaws.com", "s3express:CreateSession", false, false},
+		{"sqs.us-east-1.amazonaws.com", "sqs:SendMessage", true, false},
+	}
+
+	for _, test := range tests {
+		if got := s.isActionExcluded(Entry{Host: test.host}, test.action, test.shared); got != test.want {
+			t.Errorf("isActionExcluded(%s, %s, %v) = %v, want %v", test.host, test.action, test.shared, got, test.want)
+		}
+	}
+}
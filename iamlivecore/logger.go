@@ -5,7 +5,6 @@ import (
 	b64 "encoding/base64"
 	"encoding/json"
 	"fmt"
-	"log"
 	"net/url"
 	"os"
 	"reflect"
@@ -13,6 +12,7 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/buger/goterm"
@@ -34,10 +34,6 @@ var bGCPIAMMap []byte
 //go:embed iam_definition.json
 var bIAMSAR []byte
 
-var callLog []Entry
-var gcpCallLog []string
-var azureCallLog []AzureEntry
-
 type AzureEntry struct {
 	HTTPMethod string
 	Path       string
@@ -46,10 +42,9 @@ type AzureEntry struct {
 }
 
 // JSON maps
-var iamMap iamMapBase
-var azureIamMap azureIamMapBase
-var gcpIamMap gcpIamMapBase
 var iamDef []iamDefService
+var iamDefOnce sync.Once
+var iamDefErr error
 
 // Entry is a single CSM entry
 type Entry struct {
@@ -63,10 +58,25 @@ type Entry struct {
 	AccessKey           string `json:"AccessKey"`
 	SessionToken        string `json:"SessionToken"`
 	Host                string `json:"_Host"`
+	Timestamp           int64  `json:"Timestamp"` // milliseconds since the epoch the call was made at
+
+	ClientID                 string `json:"ClientId"`
+	UserAgent                string `json:"UserAgent"`
+	AttemptCount             int    `json:"AttemptCount"`
+	Latency                  int    `json:"Latency"`
+	FinalAWSException        string `json:"FinalAwsException"`
+	FinalAWSExceptionMessage string `json:"FinalAwsExceptionMessage"`
+
+	// ApiCallAttempt records
+	HTTPStatusCode      int    `json:"HttpStatusCode"`
+	AWSException        string `json:"AwsException"`
+	AWSExceptionMessage string `json:"AwsExceptionMessage"`
+	AttemptLatency      int    `json:"AttemptLatency"`
 }
 
 // Statement is a single statement within an IAM policy
 type Statement struct {
+	Sid      string      `json:"Sid,omitempty"`
 	Effect   string      `json:"Effect"`
 	Action   []string    `json:"Action"`
 	Resource interface{} `json:"Resource"`
@@ -88,207 +98,239 @@ type AzureIAMPolicy struct {
 	AssignableScopes []string `json:"AssignableScopes"`
 }
 
-func loadMaps() {
-	if *providerFlag == "aws" {
-		if *overrideAwsMapFlag != "" {
-			bIAMMap, err := os.ReadFile(*overrideAwsMapFlag)
-			if err != nil {
-				log.Fatal(err)
-			}
-			err = json.Unmarshal(bIAMMap, &iamMap)
+func (s *Session) loadMaps() error {
+	if s.isProviderEnabled("aws") {
+		data := bIAMMap
+		if s.options.OverrideAWSMap != "" {
+			var err error
+			data, err = os.ReadFile(s.options.OverrideAWSMap)
 			if err != nil {
-				log.Fatal(err)
-			}
-		} else {
-			err := json.Unmarshal(bIAMMap, &iamMap)
-			if err != nil {
-				log.Fatal(err)
+				return err
 			}
 		}
-		err := json.Unmarshal(bIAMSAR, &iamDef)
+		err := json.Unmarshal(data, &s.iamMap)
 		if err != nil {
-			panic(err)
+			return fmt.Errorf("error parsing AWS mapping file: %v", err)
+		}
+		s.addDataPlaneIAMMappings()
+		if err := s.loadImplicitPermissionRules(); err != nil {
+			return err
+		}
+
+		if err := loadIAMDefinitions(); err != nil {
+			return err
 		}
 	}
-	if *providerFlag == "azure" {
-		err := json.Unmarshal(bAzureIAMMap, &azureIamMap)
+	if s.isProviderEnabled("azure") {
+		err := json.Unmarshal(bAzureIAMMap, &s.azureIamMap)
 		if err != nil {
-			log.Fatal(err)
+			return fmt.Errorf("error parsing Azure mapping file: %v", err)
 		}
 	}
-	if *providerFlag == "gcp" {
-		err := json.Unmarshal(bGCPIAMMap, &gcpIamMap)
+	if s.isProviderEnabled("gcp") {
+		err := json.Unmarshal(bGCPIAMMap, &s.gcpIamMap)
 		if err != nil {
-			log.Fatal(err)
+			return fmt.Errorf("error parsing GCP mapping file: %v", err)
 		}
 	}
+
+	return s.applyMapOverlays()
 }
 
+// loadIAMDefinitions parses the embedded IAM definitions, which sessions share as they are never modified
+func loadIAMDefinitions() error {
+	iamDefOnce.Do(func() {
+		iamDefErr = json.Unmarshal(bIAMSAR, &iamDef)
+	})
+
+	return iamDefErr
+}
+
+// ClearLog forgets the calls captured so far by the default session
 func ClearLog() {
-	callLog = []Entry{}
+	getDefaultSession().Reset()
 }
 
+// GetPolicyDocument returns the policy for the enabled provider, or the policies of all enabled providers keyed by provider
 func GetPolicyDocument() []byte {
-	if *providerFlag == "aws" {
-		policy := IAMPolicy{
-			Version:   "2012-10-17",
-			Statement: []Statement{},
-		}
+	return getDefaultSession().PolicyDocument()
+}
 
-		if *modeFlag == "csm" {
-			var actions []string
+// GetProviderPolicyDocument returns the policy for a single provider
+func GetProviderPolicyDocument(provider string) []byte {
+	return getDefaultSession().ProviderPolicyDocument(provider)
+}
 
-			for _, entry := range callLog {
-				if *failsonlyFlag && (entry.FinalHTTPStatusCode >= 200 && entry.FinalHTTPStatusCode <= 299) {
-					continue
-				}
+// getCallLogs returns copies of the call logs, which are appended to while calls are captured
+func (s *Session) getCallLogs() ([]Entry, []AzureEntry, []string, []unrecognizedEntry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-				newActions := getDependantActions(getActions(entry.Service, entry.Method))
-				for _, newAction := range newActions {
-					foundAction := false
+	return append([]Entry{}, s.callLog...), append([]AzureEntry{}, s.azureCallLog...), append([]string{}, s.gcpCallLog...), append([]unrecognizedEntry{}, s.unrecognizedCallLog...)
+}
 
-					for _, action := range actions {
-						if action == newAction {
-							foundAction = true
-							break
-						}
-					}
-					if !foundAction {
-						actions = append(actions, newAction)
+func (s *Session) getAWSPolicy() IAMPolicy {
+	callLog, _, _, _ := s.getCallLogs()
+
+	policy := IAMPolicy{
+		Version:   "2012-10-17",
+		Statement: []Statement{},
+	}
+	if s.options.Mode == "csm" {
+		var actions []string
+
+		for _, entry := range callLog {
+			if s.options.FailsOnly && (entry.FinalHTTPStatusCode >= 200 && entry.FinalHTTPStatusCode <= 299) {
+				continue
+			}
+
+			newActions := getDependantActions(s.getActions(entry.Service, entry.Method))
+			for _, newAction := range newActions {
+				foundAction := false
+
+				for _, action := range actions {
+					if action == newAction {
+						foundAction = true
+						break
 					}
 				}
+				if !foundAction {
+					actions = append(actions, newAction)
+				}
 			}
+		}
 
-			if *sortAlphabeticalFlag {
-				sort.Strings(actions)
-			}
+		if s.options.SortAlphabetical {
+			sort.Strings(actions)
+		}
 
-			policy.Statement = append(policy.Statement, Statement{
-				Effect:   "Allow",
-				Resource: "*",
-				Action:   actions,
-			})
-		} else if *modeFlag == "proxy" {
-			for _, entry := range callLog {
-				if *failsonlyFlag && (entry.FinalHTTPStatusCode >= 200 && entry.FinalHTTPStatusCode <= 299) {
-					continue
-				}
+		policy.Statement = append(policy.Statement, Statement{
+			Effect:   "Allow",
+			Resource: "*",
+			Action:   actions,
+		})
+	} else {
+		proxyCalls, csmOnlyCalls := callLog, []Entry{}
+		if s.options.Mode == "hybrid" { // resources come from the proxy, falling back to actions only for CSM
+			proxyCalls, csmOnlyCalls = s.correlateHybridCalls(callLog)
+		}
 
-				policy.Statement = append(policy.Statement, getStatementsForProxyCall(entry)...)
+		for _, entry := range proxyCalls {
+			if s.options.FailsOnly && (entry.FinalHTTPStatusCode >= 200 && entry.FinalHTTPStatusCode <= 299) {
+				continue
 			}
 
-			if *forceWildcardResourceFlag {
-				for i, _ := range policy.Statement {
-					policy.Statement[i].Resource = []string{"*"}
-				}
+			policy.Statement = append(policy.Statement, s.getStatementsForProxyCall(entry)...)
+			policy.Statement = append(policy.Statement, s.getImplicitStatementsForProxyCall(entry)...)
+		}
+
+		if s.options.ForceWildcardResource {
+			for i, _ := range policy.Statement {
+				policy.Statement[i].Resource = []string{"*"}
 			}
+		}
 
-			policy = aggregatePolicy(policy)
+		policy = s.aggregatePolicy(policy)
 
-			for i := 0; i < len(policy.Statement); i++ { // make any single wildcard resource a non-array
-				resource := policy.Statement[i].Resource.([]string)
-				if len(resource) == 1 {
-					policy.Statement[i].Resource = resource[0]
-				}
+		for i := 0; i < len(policy.Statement); i++ { // make any single wildcard resource a non-array
+			resource := policy.Statement[i].Resource.([]string)
+			if len(resource) == 1 {
+				policy.Statement[i].Resource = resource[0]
 			}
 		}
 
-		doc, err := json.MarshalIndent(policy, "", "    ")
-		if err != nil {
-			panic(err)
-		}
-		return doc
-	}
-	if *providerFlag == "azure" {
-		actionsMap := make(map[string]bool)
-		dataActionsMap := make(map[string]bool)
-
-		for _, entry := range azureCallLog {
-			for pathName, pathObj := range azureIamMap[strings.ToUpper(entry.HTTPMethod)] {
-				pathmatch := urlpath.New(strings.ReplaceAll(strings.ReplaceAll(pathName, "{", ":"), "}", ""))
-				pathmatchdata, ok := pathmatch.Match(entry.Path)
-				if ok {
-				PermissionLoop:
-					for permissionName, permissionObj := range pathObj {
-						if permissionObj.Condition.BodyPathExists != "" {
-							var jsondata interface{}
-							json.Unmarshal(entry.Body, &jsondata)
-							_, err := jsonpath.JsonPathLookup(jsondata, permissionObj.Condition.BodyPathExists)
-							if err != nil {
-								continue PermissionLoop
-							}
-						}
-						for pathName, pathValue := range permissionObj.Condition.PathEquals {
-							if pathmatchdata.Params[pathName] != pathValue {
-								continue PermissionLoop
-							}
+		if statement, ok := s.getCSMOnlyStatement(policy, csmOnlyCalls); ok {
+			policy.Statement = append(policy.Statement, statement)
+		}
+	}
+
+	return policy
+}
+
+func (s *Session) getAzurePolicy() AzureIAMPolicy {
+	_, azureCallLog, _, _ := s.getCallLogs()
+
+	actionsMap := make(map[string]bool)
+	dataActionsMap := make(map[string]bool)
+
+	for _, entry := range azureCallLog {
+		for pathName, pathObj := range s.azureIamMap[strings.ToUpper(entry.HTTPMethod)] {
+			pathmatch := urlpath.New(strings.ReplaceAll(strings.ReplaceAll(pathName, "{", ":"), "}", ""))
+			pathmatchdata, ok := pathmatch.Match(entry.Path)
+			if ok {
+			PermissionLoop:
+				for permissionName, permissionObj := range pathObj {
+					if permissionObj.Condition.BodyPathExists != "" {
+						var jsondata interface{}
+						json.Unmarshal(entry.Body, &jsondata)
+						_, err := jsonpath.JsonPathLookup(jsondata, permissionObj.Condition.BodyPathExists)
+						if err != nil {
+							continue PermissionLoop
 						}
-						if permissionObj.IsDataAction {
-							dataActionsMap[permissionName] = true
-						} else {
-							actionsMap[permissionName] = true
+					}
+					for pathName, pathValue := range permissionObj.Condition.PathEquals {
+						if pathmatchdata.Params[pathName] != pathValue {
+							continue PermissionLoop
 						}
 					}
+					if permissionObj.IsDataAction {
+						dataActionsMap[permissionName] = true
+					} else {
+						actionsMap[permissionName] = true
+					}
 				}
 			}
 		}
+	}
 
-		actionsList := make([]string, len(actionsMap))
-		i := 0
-		for k := range actionsMap {
-			actionsList[i] = k
-			i++
-		}
-		sort.Strings(actionsList)
+	actionsList := make([]string, len(actionsMap))
+	i := 0
+	for k := range actionsMap {
+		actionsList[i] = k
+		i++
+	}
+	sort.Strings(actionsList)
 
-		dataActionsList := make([]string, len(dataActionsMap))
-		i = 0
-		for k := range dataActionsMap {
-			dataActionsList[i] = k
-			i++
-		}
-		sort.Strings(dataActionsList)
+	dataActionsList := make([]string, len(dataActionsMap))
+	i = 0
+	for k := range dataActionsMap {
+		dataActionsList[i] = k
+		i++
+	}
+	sort.Strings(dataActionsList)
+
+	returnPolicy := AzureIAMPolicy{
+		Actions:          actionsList,
+		DataActions:      dataActionsList,
+		NotDataActions:   make([]string, 0),
+		AssignableScopes: make([]string, 0),
+		IsCustom:         true,
+	}
 
-		returnPolicy := AzureIAMPolicy{
-			Actions:          actionsList,
-			DataActions:      dataActionsList,
-			NotDataActions:   make([]string, 0),
-			AssignableScopes: make([]string, 0),
-			IsCustom:         true,
-		}
+	return returnPolicy
+}
 
-		doc, err := json.MarshalIndent(returnPolicy, "", "    ")
-		if err != nil {
-			panic(err)
-		}
-		return doc
-	}
-	if *providerFlag == "gcp" {
-		actionsMap := make(map[string]bool)
+func (s *Session) getGCPPermissions() []string {
+	_, _, gcpCallLog, _ := s.getCallLogs()
 
-		for _, entry := range gcpCallLog {
-			entryServiceName := strings.Split(entry, ".")[0]
-			for _, mapPermission := range gcpIamMap.API[entryServiceName].Methods[entry].Permissions {
-				actionsMap[mapPermission.Name] = true
-			}
-		}
+	actionsMap := make(map[string]bool)
 
-		actionsList := make([]string, len(actionsMap))
-		i := 0
-		for k := range actionsMap {
-			actionsList[i] = k
-			i++
+	for _, entry := range gcpCallLog {
+		entryServiceName := strings.Split(entry, ".")[0]
+		for _, mapPermission := range s.gcpIamMap.API[entryServiceName].Methods[entry].Permissions {
+			actionsMap[mapPermission.Name] = true
 		}
-		sort.Strings(actionsList)
+	}
 
-		doc, err := json.MarshalIndent(actionsList, "", "    ")
-		if err != nil {
-			panic(err)
-		}
-		return doc
+	actionsList := make([]string, len(actionsMap))
+	i := 0
+	for k := range actionsMap {
+		actionsList[i] = k
+		i++
 	}
+	sort.Strings(actionsList)
 
-	return []byte("ERROR")
+	return actionsList
 }
 
 func removeStatementItem(slice []Statement, i int) []Statement {
@@ -296,7 +338,7 @@ func removeStatementItem(slice []Statement, i int) []Statement {
 	return slice[:len(slice)-1]
 }
 
-func aggregatePolicy(policy IAMPolicy) IAMPolicy {
+func (s *Session) aggregatePolicy(policy IAMPolicy) IAMPolicy {
 	for i := 0; i < len(policy.Statement); i++ {
 		sort.Strings(policy.Statement[i].Resource.([]string))
 		for j := i + 1; j < len(policy.Statement); j++ {
@@ -311,7 +353,7 @@ func aggregatePolicy(policy IAMPolicy) IAMPolicy {
 
 		actions := uniqueSlice(policy.Statement[i].Action)
 
-		if *sortAlphabeticalFlag {
+		if s.options.SortAlphabetical {
 			sort.Strings(actions)
 		}
 
@@ -322,11 +364,11 @@ func aggregatePolicy(policy IAMPolicy) IAMPolicy {
 	return policy
 }
 
-func handleLoggedCall() {
+func (s *Session) handleLoggedCall() {
 	// when making many calls in parallel, the terminal can be glitchy
 	// if we flush too often, optional flush on timer
-	if *refreshRateFlag == 0 {
-		writePolicyToTerminal()
+	if s.options.Terminal && s.options.RefreshRate == 0 {
+		s.writePolicyToTerminal()
 	}
 }
 
@@ -340,14 +382,26 @@ func countRune(s string, r rune) int {
 	return count
 }
 
-func writePolicyToTerminal() {
-	if (len(callLog) == 0 && len(azureCallLog) == 0 && len(gcpCallLog) == 0) || *backgroundFlag {
+func (s *Session) writePolicyToTerminal() {
+	s.mu.Lock()
+	empty := len(s.callLog) == 0 && len(s.azureCallLog) == 0 && len(s.gcpCallLog) == 0 && len(s.unrecognizedCallLog) == 0
+	s.mu.Unlock()
+	if empty || !s.options.Terminal {
 		return
 	}
 
-	policyDoc := string(GetPolicyDocument())
+	policyDoc := string(s.PolicyDocument())
+	if s.options.Coverage && s.isProviderEnabled("aws") {
+		policyDoc += "\n\n" + s.getCoverageSummary()
+	}
+	if s.options.CallStats && s.options.Mode != "proxy" {
+		policyDoc += "\n\n" + s.getCallStatsSummary()
+	}
+	if s.options.Mode == "hybrid" {
+		policyDoc += "\n\n" + s.getHybridSummary()
+	}
 
-	if *debugFlag {
+	if s.options.Debug {
 		fmt.Println(policyDoc)
 	} else {
 		policyHeight := countRune(policyDoc, '\n') + 1
@@ -365,13 +419,13 @@ func writePolicyToTerminal() {
 
 type iamMapMethod struct {
 	Action              string                      `json:"action"`
-	ResourceMappings    map[string]iamMapResMapItem `json:"resource_mappings"`
-	ResourceARNMappings map[string]string           `json:"resourcearn_mappings"`
+	ResourceMappings    map[string]iamMapResMapItem `json:"resource_mappings,omitempty"`
+	ResourceARNMappings map[string]string           `json:"resourcearn_mappings,omitempty"`
 	ArnOverride         iamMapArnOverride           `json:"arn_override"`
 }
 
 type iamMapArnOverride struct {
-	Template string `json:"template"`
+	Template string `json:"template,omitempty"`
 }
 
 type iamMapResMapItem struct {
@@ -382,6 +436,7 @@ type iamMapBase struct {
 	SDKMethodIAMMappings     map[string][]iamMapMethod `json:"sdk_method_iam_mappings"`
 	SDKServiceMappings       map[string]string         `json:"sdk_service_mappings"`
 	SDKPermissionlessActions []string                  `json:"sdk_permissionless_actions"`
+	SDKServiceNameAliases    map[string]string         `json:"sdk_service_name_aliases"`
 }
 
 type azureIamMapBase map[string]AzurePath
@@ -482,18 +537,18 @@ func getDependantActions(actions []string) []string {
 	return uniqueSlice(actions)
 }
 
-func getActions(service, method string) []string {
+func (s *Session) getActions(service, method string) []string {
 	var actions []string
 
 	// checked if permissionless
-	for _, permissionlessAction := range iamMap.SDKPermissionlessActions {
+	for _, permissionlessAction := range s.iamMap.SDKPermissionlessActions {
 		if strings.ToLower(permissionlessAction) == fmt.Sprintf("%s.%s", strings.ToLower(service), strings.ToLower(method)) {
 			return []string{}
 		}
 	}
 
 	// check IAM mappings
-	for sdkCall, mappingInfo := range iamMap.SDKMethodIAMMappings {
+	for sdkCall, mappingInfo := range s.iamMap.SDKMethodIAMMappings {
 		if fmt.Sprintf("%s.%s", strings.ToLower(service), strings.ToLower(method)) == strings.ToLower(sdkCall) {
 			for _, item := range mappingInfo {
 				actions = append(actions, item.Action)
@@ -506,7 +561,7 @@ func getActions(service, method string) []string {
 	}
 
 	// substitute service name
-	for sdkService, iamService := range iamMap.SDKServiceMappings {
+	for sdkService, iamService := range s.iamMap.SDKServiceMappings {
 		if service == sdkService {
 			service = iamService
 			break
@@ -518,31 +573,26 @@ func getActions(service, method string) []string {
 	}
 }
 
-func setTerminalRefresh() {
-	if *refreshRateFlag <= 0 {
-		*refreshRateFlag = 1
-	}
-
-	ticker := time.NewTicker(time.Duration(*refreshRateFlag) * time.Second)
-	quit := make(chan struct{})
-	go func() {
-		for {
-			select {
-			case <-ticker.C:
-				writePolicyToTerminal()
-			case <-quit:
-				ticker.Stop()
-				return
-			}
+// refreshTerminal writes the policy to the terminal every RefreshRate seconds, until the session is stopped
+func (s *Session) refreshTerminal() {
+	ticker := time.NewTicker(time.Duration(s.options.RefreshRate) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.writePolicyToTerminal()
+		case <-s.stopped:
+			return
 		}
-	}()
+	}
 }
 
 type resourceType struct {
 	ResourceType string `json:"resourceType"`
 }
 
-func resolveSpecials(arn string, call Entry, mandatory bool, resourceArnTemplate *string) []string {
+func (s *Session) resolveSpecials(arn string, call Entry, mandatory bool, resourceArnTemplate *string) []string {
 	startIndex := strings.Index(arn, "%%")
 	endIndex := strings.LastIndex(arn, "%%")
 
@@ -563,7 +613,7 @@ func resolveSpecials(arn string, call Entry, mandatory bool, resourceArnTemplate
 				return []string{arn[0:startIndex] + "*" + arn[endIndex+2:]}
 			}
 
-			fullyResolved, arns := subARNParameters(parts[1], call, true)
+			fullyResolved, arns := s.subARNParameters(parts[1], call, true)
 
 			if len(arns) < 1 || arns[0] == "" || !fullyResolved {
 				if parts[3] == "" {
@@ -587,7 +637,7 @@ func resolveSpecials(arn string, call Entry, mandatory bool, resourceArnTemplate
 				return []string{arn[0:startIndex] + "*" + arn[endIndex+2:]}
 			}
 
-			fullyResolved, arns := subARNParameters(parts[1], call, true)
+			fullyResolved, arns := s.subARNParameters(parts[1], call, true)
 			if len(arns) < 1 || arns[0] == "" || !fullyResolved {
 				if mandatory {
 					return []string{arn[0:startIndex] + "*" + arn[endIndex+2:]}
@@ -601,7 +651,7 @@ func resolveSpecials(arn string, call Entry, mandatory bool, resourceArnTemplate
 				return []string{arn[0:startIndex] + "*" + arn[endIndex+2:]}
 			}
 
-			fullyResolved, arns := subARNParameters(parts[1], call, true)
+			fullyResolved, arns := s.subARNParameters(parts[1], call, true)
 			if len(arns) < 1 || arns[0] == "" || !fullyResolved {
 				return []string{arn[0:startIndex] + arn[endIndex+2:]}
 			}
@@ -617,7 +667,7 @@ func resolveSpecials(arn string, call Entry, mandatory bool, resourceArnTemplate
 			manyParts := []string{}
 
 			for _, part := range parts[1:] {
-				fullyResolved, arns := subARNParameters(part, call, true)
+				fullyResolved, arns := s.subARNParameters(part, call, true)
 				if len(arns) < 1 || arns[0] == "" || !fullyResolved {
 					if mandatory {
 						return []string{arn[0:startIndex] + "*" + arn[endIndex+2:]}
@@ -634,7 +684,7 @@ func resolveSpecials(arn string, call Entry, mandatory bool, resourceArnTemplate
 				return []string{arn[0:startIndex] + "*" + arn[endIndex+2:]}
 			}
 
-			fullyResolved, arns := subARNParameters(parts[1], call, true)
+			fullyResolved, arns := s.subARNParameters(parts[1], call, true)
 
 			if len(arns) < 1 || arns[0] == "" || !fullyResolved {
 				if mandatory {
@@ -666,37 +716,39 @@ func resolveSpecials(arn string, call Entry, mandatory bool, resourceArnTemplate
 	return []string{arn}
 }
 
-func getStatementsForProxyCall(call Entry) (statements []Statement) {
+func (s *Session) getStatementsForProxyCall(call Entry) (statements []Statement) {
+	return s.resolveProxyCallStatements(call, nil)
+}
+
+// resolveProxyCallStatements returns the statements for a call, recording any resources which collapsed to wildcards
+// in the coverage report when one is given
+func (s *Session) resolveProxyCallStatements(call Entry, coverage *CoverageReport) (statements []Statement) {
 	lowerPriv := strings.ToLower(fmt.Sprintf("%s.%s", call.Service, call.Method))
 
-	for iamMapMethodName, iamMapMethods := range iamMap.SDKMethodIAMMappings {
+	for iamMapMethodName, iamMapMethods := range s.iamMap.SDKMethodIAMMappings {
 		if strings.ToLower(iamMapMethodName) == lowerPriv {
 			for mappedPrivIndex, mappedPriv := range iamMapMethods {
-				// special handling for S3 express
-				if strings.HasPrefix(mappedPriv.Action, "s3express:") && len(iamMapMethods) > 1 && !strings.HasPrefix(call.Host, "s3express-control.") {
+				if s.isActionExcluded(call, mappedPriv.Action, len(iamMapMethods) > 1) {
 					continue
 				}
-				if strings.HasPrefix(mappedPriv.Action, "s3:") && len(iamMapMethods) > 1 && strings.HasPrefix(call.Host, "s3express-control.") {
-					continue
-				}
-				if strings.HasPrefix(mappedPriv.Action, "s3:") && strings.Contains(call.Host, ".s3express-") {
-					continue // Zonal API actions
-				}
 
 				resources := []string{}
 
 				// arn_override
 				if mappedPriv.ArnOverride.Template != "" {
-					arns := resolveSpecials(mappedPriv.ArnOverride.Template, call, false, nil)
+					arns := s.resolveSpecials(mappedPriv.ArnOverride.Template, call, false, nil)
 
 					if len(arns) == 0 || len(arns) > 1 || arns[0] != "" { // skip if empty after resolving specials
 						for _, arn := range arns {
-							fullyResolved, subbedArns := subARNParameters(arn, call, false)
+							fullyResolved, subbedArns := s.subARNParameters(arn, call, false)
 							for _, subbedArn := range subbedArns {
 								if mappedPrivIndex == 0 || fullyResolved {
 									resources = append(resources, subbedArn) // sub full parameters and add to resources
 								}
 							}
+							if mappedPrivIndex == 0 && !fullyResolved {
+								s.addWildcardResources(coverage, call, mappedPriv.Action, arn, subbedArns)
+							}
 						}
 					}
 
@@ -722,20 +774,24 @@ func getStatementsForProxyCall(call Entry) (statements []Statement) {
 											if strings.Replace(resourceType.ResourceType, "*", "", -1) == mapResType {
 												mandatory := strings.HasSuffix(resourceType.ResourceType, "*")
 
-												resARNMappingTemplates := resolveSpecials(mapResTemplate, call, false, &resourceArnTemplate)
+												resARNMappingTemplates := s.resolveSpecials(mapResTemplate, call, false, &resourceArnTemplate)
 												if len(resARNMappingTemplates) == 1 && resARNMappingTemplates[0] == "" {
 													continue
 												}
 
 												if len(resARNMappingTemplates) == 0 && mandatory && len(mappedPriv.ResourceMappings) == 0 {
 													resARNMappingTemplates = []string{"*"}
+													s.addWildcardResources(coverage, call, mappedPriv.Action, mapResTemplate, resARNMappingTemplates)
 												}
 
 												for _, resARNMappingTemplate := range resARNMappingTemplates {
-													fullyResolved, subbedArns := subARNParameters(resARNMappingTemplate, call, false)
+													fullyResolved, subbedArns := s.subARNParameters(resARNMappingTemplate, call, false)
 													if mandatory || fullyResolved { // check if mandatory or fully resolved
 														resources = append(resources, subbedArns...) // sub full parameters and add to resources
 													}
+													if mandatory && !fullyResolved {
+														s.addWildcardResources(coverage, call, mappedPriv.Action, resARNMappingTemplate, subbedArns)
+													}
 												}
 											}
 										}
@@ -761,7 +817,7 @@ func getStatementsForProxyCall(call Entry) (statements []Statement) {
 
 												// substitute the resource_mappings
 												for resMappingVar, resMapping := range mappedPriv.ResourceMappings { // for each mapping
-													resMappingTemplates := resolveSpecials(resMapping.Template, call, false, &resource.Arn) // get a list of resolved template strings
+													resMappingTemplates := s.resolveSpecials(resMapping.Template, call, false, &resource.Arn) // get a list of resolved template strings
 
 													if len(resMappingTemplates) == 1 && resMappingTemplates[0] == "" {
 														continue
@@ -780,13 +836,17 @@ func getStatementsForProxyCall(call Entry) (statements []Statement) {
 
 												if len(arns) == 0 && mandatory {
 													arns = []string{"*"}
+													s.addWildcardResources(coverage, call, mappedPriv.Action, resource.Arn, arns)
 												}
 
 												for _, arn := range arns {
-													fullyResolved, subbedArns := subARNParameters(arn, call, false)
+													fullyResolved, subbedArns := s.subARNParameters(arn, call, false)
 													if mandatory || fullyResolved { // check if mandatory or fully resolved
 														resources = append(resources, subbedArns...) // sub full parameters and add to resources
 													}
+													if mandatory && !fullyResolved {
+														s.addWildcardResources(coverage, call, mappedPriv.Action, arn, subbedArns)
+													}
 												}
 											}
 										}
@@ -803,12 +863,17 @@ func getStatementsForProxyCall(call Entry) (statements []Statement) {
 						continue
 					}
 					resources = []string{"*"}
+					if hasSARResourceTypes(mappedPriv.Action) {
+						s.addWildcardResources(coverage, call, mappedPriv.Action, "", resources)
+					}
 				}
 
+				action, resources := s.applyS3Endpoint(call, mappedPriv.Action, resources)
+
 				statements = append(statements, Statement{
 					Effect:   "Allow",
 					Resource: resources,
-					Action:   []string{mappedPriv.Action},
+					Action:   []string{action},
 				})
 			}
 		}
@@ -903,7 +968,30 @@ func (s *uniqueStringList) addParam(arns []string, paramVarName, param string) {
 	}
 }
 
-func subARNParameters(arn string, call Entry, specialsOnly bool) (bool, []string) {
+func getPartitionFromRegion(region string) string {
+	if strings.HasPrefix(region, "cn") {
+		return "aws-cn"
+	}
+	if strings.HasPrefix(region, "us-gov") {
+		return "aws-us-gov"
+	}
+	return "aws"
+}
+
+var arnVariableRegex = regexp.MustCompile(`\$\{(.+?)\}`)
+
+// isPreservedPolicyVariable returns whether a template variable is an IAM policy variable, such as ${aws:username} or
+// ${aws:PrincipalTag/team}, to be kept in the policy
+func (s *Session) isPreservedPolicyVariable(name string) bool {
+	if !s.options.PolicyVariables {
+		return false
+	}
+
+	// Doc: https://docs.aws.amazon.com/IAM/latest/UserGuide/reference_policies_variables.html
+	return strings.Contains(name, ":") || name == "*" || name == "?" || name == "$"
+}
+
+func (s *Session) subARNParameters(arn string, call Entry, specialsOnly bool) (bool, []string) {
 	arns := []string{arn}
 	// parameter substitution
 	for paramVarName, params := range call.Parameters {
@@ -924,16 +1012,17 @@ func subARNParameters(arn string, call Entry, specialsOnly bool) (bool, []string
 	if specialsOnly {
 		anyMatched := false
 		for _, arn := range arns {
-			matched, _ := regexp.Match(`\$\{.+?\}`, []byte(arn))
-			if matched {
-				anyMatched = true
+			for _, variableMatch := range arnVariableRegex.FindAllStringSubmatch(arn, -1) {
+				if !s.isPreservedPolicyVariable(variableMatch[1]) {
+					anyMatched = true
+				}
 			}
 		}
 
 		return !anyMatched, arns
 	}
 
-	account := *accountIDFlag
+	account := s.options.AccountID
 	var err error
 
 	if account == "" && call.AccessKey != "" {
@@ -957,25 +1046,36 @@ func subARNParameters(arn string, call Entry, specialsOnly bool) (bool, []string
 		}
 	}
 
-	partition := "aws"
-	if strings.HasPrefix(region, "cn") {
-		partition = "aws-cn"
+	partition := getPartitionFromRegion(region)
+
+	if s.options.ARNPlaceholders { // CloudFormation pseudo parameters, for use with Fn::Sub
+		partition, region, account = "${AWS::Partition}", "${AWS::Region}", "${AWS::AccountId}"
 	}
-	if strings.HasPrefix(region, "us-gov") {
-		partition = "aws-us-gov"
+	if s.options.ARNRegion != "" {
+		region = s.options.ARNRegion
+	}
+	if s.options.ARNAccount != "" {
+		account = s.options.ARNAccount
 	}
 
 	anyUnresolved := false
 	result := []string{}
 	for _, arn := range arns {
-		arn = regexp.MustCompile(`\$\{Partition\}`).ReplaceAllString(arn, partition)
-		arn = regexp.MustCompile(`\$\{Region\}`).ReplaceAllString(arn, region)
-		arn = regexp.MustCompile(`\$\{Account\}`).ReplaceAllString(arn, account)
-		unresolvedArn := arn
-		arn = regexp.MustCompile(`\$\{.+?\}`).ReplaceAllString(arn, "*") // TODO: preserve ${aws:*} variables
-		if unresolvedArn != arn {
+		// in a single pass, so that placeholders and policy variables aren't substituted again
+		arn = arnVariableRegex.ReplaceAllStringFunc(arn, func(variable string) string {
+			switch name := arnVariableRegex.FindStringSubmatch(variable)[1]; {
+			case name == "Partition":
+				return partition
+			case name == "Region":
+				return region
+			case name == "Account":
+				return account
+			case s.isPreservedPolicyVariable(name):
+				return variable
+			}
 			anyUnresolved = true
-		}
+			return "*"
+		})
 		result = append(result, arn)
 	}
 
@@ -0,0 +1,292 @@
+package iamlivecore
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+// iamMapOverlay is a partial AWS mapping file merged over the embedded one
+type iamMapOverlay struct {
+	Replace iamMapBase     `json:"replace"` // methods and service mappings of the same name are replaced, the permissionless action list when given
+	Add     iamMapBase     `json:"add"`     // mappings are appended to those of the same method
+	Remove  iamMapRemovals `json:"remove"`
+}
+
+type iamMapRemovals struct {
+	SDKMethodIAMMappings     []string `json:"sdk_method_iam_mappings"`
+	SDKServiceMappings       []string `json:"sdk_service_mappings"`
+	SDKPermissionlessActions []string `json:"sdk_permissionless_actions"`
+	SDKServiceNameAliases    []string `json:"sdk_service_name_aliases"`
+}
+
+// azureIamMapOverlay is a partial Azure mapping file merged over the embedded one
+type azureIamMapOverlay struct {
+	Replace azureIamMapBase     `json:"replace"` // paths of the same HTTP method are replaced
+	Add     azureIamMapBase     `json:"add"`     // permissions are added to the path of the same HTTP method
+	Remove  map[string][]string `json:"remove"`  // HTTP method to paths
+}
+
+// gcpIamMapOverlay is a partial GCP mapping file merged over the embedded one
+type gcpIamMapOverlay struct {
+	Replace gcpIamMapBase `json:"replace"` // methods of the same service are replaced
+	Add     gcpIamMapBase `json:"add"`     // permissions are appended to those of the same method
+	Remove  struct {
+		API map[string][]string `json:"api"` // service to methods
+	} `json:"remove"`
+}
+
+func getOverlayFiles(files string) []string {
+	paths := []string{}
+	for _, path := range strings.Split(files, ",") {
+		if path = strings.TrimSpace(path); path != "" {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
+func readOverlayFile(path string, overlay interface{}) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	err = json.Unmarshal(data, overlay)
+	if err != nil {
+		return fmt.Errorf("error parsing mapping overlay file %s: %v", path, err)
+	}
+
+	return nil
+}
+
+// findMapKey returns the key matching name case-insensitively, as mappings are looked up
+func findMapKey(keys []string, name string) (string, bool) {
+	for _, key := range keys {
+		if strings.ToLower(key) == strings.ToLower(name) {
+			return key, true
+		}
+	}
+	return name, false
+}
+
+func (s *Session) getIAMMapMethodNames() []string {
+	names := []string{}
+	for name := range s.iamMap.SDKMethodIAMMappings {
+		names = append(names, name)
+	}
+	return names
+}
+
+func (s *Session) applyIAMMapOverlay(overlay iamMapOverlay) {
+	if s.iamMap.SDKMethodIAMMappings == nil {
+		s.iamMap.SDKMethodIAMMappings = map[string][]iamMapMethod{}
+	}
+	if s.iamMap.SDKServiceMappings == nil {
+		s.iamMap.SDKServiceMappings = map[string]string{}
+	}
+	if s.iamMap.SDKServiceNameAliases == nil {
+		s.iamMap.SDKServiceNameAliases = map[string]string{}
+	}
+
+	for _, method := range overlay.Remove.SDKMethodIAMMappings {
+		key, _ := findMapKey(s.getIAMMapMethodNames(), method)
+		delete(s.iamMap.SDKMethodIAMMappings, key)
+	}
+	for _, service := range overlay.Remove.SDKServiceMappings {
+		delete(s.iamMap.SDKServiceMappings, service)
+	}
+	for _, service := range overlay.Remove.SDKServiceNameAliases {
+		delete(s.iamMap.SDKServiceNameAliases, service)
+	}
+	permissionlessActions := []string{}
+	for _, action := range s.iamMap.SDKPermissionlessActions {
+		if _, removed := findMapKey(overlay.Remove.SDKPermissionlessActions, action); !removed {
+			permissionlessActions = append(permissionlessActions, action)
+		}
+	}
+	s.iamMap.SDKPermissionlessActions = permissionlessActions
+
+	for method, mappings := range overlay.Replace.SDKMethodIAMMappings {
+		key, _ := findMapKey(s.getIAMMapMethodNames(), method)
+		s.iamMap.SDKMethodIAMMappings[key] = mappings
+	}
+	for service, mapping := range overlay.Replace.SDKServiceMappings {
+		s.iamMap.SDKServiceMappings[service] = mapping
+	}
+	for service, alias := range overlay.Replace.SDKServiceNameAliases {
+		s.iamMap.SDKServiceNameAliases[service] = alias
+	}
+	if overlay.Replace.SDKPermissionlessActions != nil {
+		s.iamMap.SDKPermissionlessActions = overlay.Replace.SDKPermissionlessActions
+	}
+
+	for method, mappings := range overlay.Add.SDKMethodIAMMappings {
+		key, _ := findMapKey(s.getIAMMapMethodNames(), method)
+		s.iamMap.SDKMethodIAMMappings[key] = append(s.iamMap.SDKMethodIAMMappings[key], mappings...)
+	}
+	for service, mapping := range overlay.Add.SDKServiceMappings {
+		s.iamMap.SDKServiceMappings[service] = mapping
+	}
+	for service, alias := range overlay.Add.SDKServiceNameAliases {
+		s.iamMap.SDKServiceNameAliases[service] = alias
+	}
+	s.iamMap.SDKPermissionlessActions = uniqueSlice(append(s.iamMap.SDKPermissionlessActions, overlay.Add.SDKPermissionlessActions...))
+}
+
+func (s *Session) applyAzureIAMMapOverlay(overlay azureIamMapOverlay) {
+	if s.azureIamMap == nil {
+		s.azureIamMap = azureIamMapBase{}
+	}
+
+	for httpMethod, paths := range overlay.Remove {
+		for _, path := range paths {
+			delete(s.azureIamMap[strings.ToUpper(httpMethod)], path)
+		}
+	}
+
+	for httpMethod, paths := range overlay.Replace {
+		httpMethod = strings.ToUpper(httpMethod)
+		if s.azureIamMap[httpMethod] == nil {
+			s.azureIamMap[httpMethod] = AzurePath{}
+		}
+		for path, permissions := range paths {
+			s.azureIamMap[httpMethod][path] = permissions
+		}
+	}
+
+	for httpMethod, paths := range overlay.Add {
+		httpMethod = strings.ToUpper(httpMethod)
+		if s.azureIamMap[httpMethod] == nil {
+			s.azureIamMap[httpMethod] = AzurePath{}
+		}
+		for path, permissions := range paths {
+			if s.azureIamMap[httpMethod][path] == nil {
+				s.azureIamMap[httpMethod][path] = AzurePermission{}
+			}
+			for permission, detail := range permissions {
+				s.azureIamMap[httpMethod][path][permission] = detail
+			}
+		}
+	}
+}
+
+func (s *Session) applyGCPIAMMapOverlay(overlay gcpIamMapOverlay) {
+	if s.gcpIamMap.API == nil {
+		s.gcpIamMap.API = map[string]GCPAPIMapService{}
+	}
+
+	for service, methods := range overlay.Remove.API {
+		for _, method := range methods {
+			delete(s.gcpIamMap.API[service].Methods, method)
+		}
+	}
+
+	for service, serviceMap := range overlay.Replace.API {
+		if s.gcpIamMap.API[service].Methods == nil {
+			s.gcpIamMap.API[service] = GCPAPIMapService{Methods: map[string]GCPAPIMapMethod{}}
+		}
+		for method, methodMap := range serviceMap.Methods {
+			s.gcpIamMap.API[service].Methods[method] = methodMap
+		}
+	}
+
+	for service, serviceMap := range overlay.Add.API {
+		if s.gcpIamMap.API[service].Methods == nil {
+			s.gcpIamMap.API[service] = GCPAPIMapService{Methods: map[string]GCPAPIMapMethod{}}
+		}
+		for method, methodMap := range serviceMap.Methods {
+			existing := s.gcpIamMap.API[service].Methods[method]
+		PermissionLoop:
+			for _, permission := range methodMap.Permissions {
+				for _, existingPermission := range existing.Permissions {
+					if existingPermission.Name == permission.Name {
+						continue PermissionLoop
+					}
+				}
+				existing.Permissions = append(existing.Permissions, permission)
+			}
+			s.gcpIamMap.API[service].Methods[method] = existing
+		}
+	}
+}
+
+func (s *Session) applyMapOverlays() error {
+	if s.isProviderEnabled("aws") {
+		for _, path := range getOverlayFiles(s.options.OverlayAWSMap) {
+			var overlay iamMapOverlay
+			if err := readOverlayFile(path, &overlay); err != nil {
+				return err
+			}
+			s.applyIAMMapOverlay(overlay)
+		}
+	}
+	if s.isProviderEnabled("azure") {
+		for _, path := range getOverlayFiles(s.options.OverlayAzureMap) {
+			var overlay azureIamMapOverlay
+			if err := readOverlayFile(path, &overlay); err != nil {
+				return err
+			}
+			s.applyAzureIAMMapOverlay(overlay)
+		}
+	}
+	if s.isProviderEnabled("gcp") {
+		for _, path := range getOverlayFiles(s.options.OverlayGCPMap) {
+			var overlay gcpIamMapOverlay
+			if err := readOverlayFile(path, &overlay); err != nil {
+				return err
+			}
+			s.applyGCPIAMMapOverlay(overlay)
+		}
+	}
+
+	return nil
+}
+
+// getEffectiveMapping returns the merged mapping for an AWS SDK method (S3.GetObject), an Azure request
+// (GET /subscriptions/{subscriptionId}/resourceGroups) or a GCP method (compute.instances.get)
+func (s *Session) getEffectiveMapping(method string) (interface{}, error) {
+	if s.isProviderEnabled("aws") {
+		if key, ok := findMapKey(s.getIAMMapMethodNames(), method); ok {
+			return map[string][]iamMapMethod{key: s.iamMap.SDKMethodIAMMappings[key]}, nil
+		}
+	}
+
+	if s.isProviderEnabled("azure") {
+		if parts := strings.SplitN(method, " ", 2); len(parts) == 2 {
+			httpMethod := strings.ToUpper(parts[0])
+			for path, permissions := range s.azureIamMap[httpMethod] {
+				if strings.ToLower(path) == strings.ToLower(strings.TrimSpace(parts[1])) {
+					return map[string]AzurePath{httpMethod: {path: permissions}}, nil
+				}
+			}
+		}
+	}
+
+	if s.isProviderEnabled("gcp") {
+		for service, serviceMap := range s.gcpIamMap.API {
+			if methodMap, ok := serviceMap.Methods[method]; ok {
+				return map[string]map[string]GCPAPIMapMethod{service: {method: methodMap}}, nil
+			}
+		}
+	}
+
+	return nil, fmt.Errorf("no mapping found for %s", method)
+}
+
+func (s *Session) printEffectiveMapping(method string) {
+	mapping, err := s.getEffectiveMapping(method)
+	if err != nil {
+		fmt.Println("ERROR: " + err.Error())
+		return
+	}
+
+	out, err := json.MarshalIndent(mapping, "", "    ")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Println(string(out))
+}
@@ -21,7 +21,9 @@ import (
 	"os"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	mxj "github.com/clbanning/mxj/v2"
@@ -56,20 +58,26 @@ find . ! -name "api-list.json" -type f -exec sh -c "cat <<< \$(jq -c '{basePath,
 //go:embed google-api-go-client/*
 var gcpServiceFiles embed.FS
 
+// API definitions, loaded once and shared by sessions
 var serviceDefinitions []ServiceDefinition
+var serviceDefinitionsOnce sync.Once
+var serviceDefinitionsErr error
 var gcpServiceDefinitions []GCPServiceDefinition
+var gcpServiceDefinitionsOnce sync.Once
+var gcpServiceDefinitionsErr error
 
-func loadCAKeys() error {
+// loadCAKeys returns the CA the proxy signs certificates with, generating it when neither file exists
+func (s *Session) loadCAKeys() (*tls.Certificate, error) {
 	var caCert []byte
 	var caKey []byte
 
-	caBundlePath, err := homedir.Expand(*caBundleFlag)
+	caBundlePath, err := homedir.Expand(s.options.CABundle)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	caKeyPath, err := homedir.Expand(*caKeyFlag)
+	caKeyPath, err := homedir.Expand(s.options.CAKey)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	if _, err := os.Stat(caBundlePath); os.IsNotExist(err) {
@@ -77,11 +85,11 @@ func loadCAKeys() error {
 			// make directories
 			err = os.MkdirAll(filepath.Dir(caBundlePath), 0700)
 			if err != nil {
-				return err
+				return nil, err
 			}
 			err = os.MkdirAll(filepath.Dir(caKeyPath), 0700)
 			if err != nil {
-				return err
+				return nil, err
 			}
 
 			// generate keys
@@ -105,12 +113,12 @@ func loadCAKeys() error {
 
 			caPrivKey, err := rsa.GenerateKey(rand.Reader, 4096)
 			if err != nil {
-				return err
+				return nil, err
 			}
 
 			caBytes, err := x509.CreateCertificate(rand.Reader, ca, ca, &caPrivKey.PublicKey, caPrivKey)
 			if err != nil {
-				return err
+				return nil, err
 			}
 
 			caPEM := new(bytes.Buffer)
@@ -131,99 +139,158 @@ func loadCAKeys() error {
 			// write data
 			err = ioutil.WriteFile(caBundlePath, caCert, 0600)
 			if err != nil {
-				return err
+				return nil, err
 			}
 			err = ioutil.WriteFile(caKeyPath, caKey, 0600)
 			if err != nil {
-				return err
+				return nil, err
 			}
 		} else {
-			return fmt.Errorf("CA bundle file exists without key file")
+			return nil, fmt.Errorf("CA bundle file exists without key file")
 		}
 	} else {
 		if _, err := os.Stat(caKeyPath); os.IsNotExist(err) {
-			return fmt.Errorf("CA key file exists without bundle file")
+			return nil, fmt.Errorf("CA key file exists without bundle file")
 		}
 
 		caCert, err = ioutil.ReadFile(caBundlePath)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		caKey, err = ioutil.ReadFile(caKeyPath)
 		if err != nil {
-			return err
+			return nil, err
 		}
 	}
 
 	goproxyCa, err := tls.X509KeyPair(caCert, caKey)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	if goproxyCa.Leaf, err = x509.ParseCertificate(goproxyCa.Certificate[0]); err != nil {
-		return err
+		return nil, err
 	}
-	goproxy.GoproxyCa = goproxyCa
-	goproxy.OkConnect = &goproxy.ConnectAction{Action: goproxy.ConnectAccept, TLSConfig: goproxy.TLSConfigFromCA(&goproxyCa)}
-	goproxy.MitmConnect = &goproxy.ConnectAction{Action: goproxy.ConnectMitm, TLSConfig: goproxy.TLSConfigFromCA(&goproxyCa)}
-	goproxy.HTTPMitmConnect = &goproxy.ConnectAction{Action: goproxy.ConnectHTTPMitm, TLSConfig: goproxy.TLSConfigFromCA(&goproxyCa)}
-	goproxy.RejectConnect = &goproxy.ConnectAction{Action: goproxy.ConnectReject, TLSConfig: goproxy.TLSConfigFromCA(&goproxyCa)}
-	return nil
+	return &goproxyCa, nil
+}
+
+func dumpReq(req *http.Request, body []byte) {
+	dump, _ := httputil.DumpRequestOut(req, false)
+	fmt.Printf("%v%v\n", string(dump), string(body))
 }
 
-func dumpReq(req *http.Request) {
-	dump, _ := httputil.DumpRequestOut(req, true)
-	fmt.Printf("%v\n", string(dump))
+type multiReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+func isParsableContentType(contentType string) bool {
+	contentType = strings.ToLower(contentType)
+
+	if contentType == "" { // unknown, rely on the size cap
+		return true
+	}
+
+	for _, parsableType := range []string{"json", "xml", "x-www-form-urlencoded", "cbor"} {
+		if strings.Contains(contentType, parsableType) {
+			return true
+		}
+	}
+
+	return false
 }
 
-func createProxy(addr string, awsRedirectHost string) {
-	err := loadCAKeys()
+// readRequestBody returns the body when the protocol may need it for parsing and it is within the size cap,
+// otherwise nil is returned and req.Body is left to stream through untouched
+func (s *Session) readRequestBody(req *http.Request) []byte {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil
+	}
+
+	if !isParsableContentType(req.Header.Get("Content-Type")) {
+		return nil
+	}
+
+	payloadHash := req.Header.Get("X-Amz-Content-Sha256")
+	if payloadHash == "UNSIGNED-PAYLOAD" || strings.HasPrefix(payloadHash, "STREAMING-") { // object payloads
+		return nil
+	}
+
+	maxBodySize := int64(s.options.MaxBodySize)
+	if req.ContentLength > maxBodySize {
+		return nil
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, maxBodySize+1))
+	if err != nil || int64(len(body)) > maxBodySize {
+		req.Body = multiReadCloser{io.MultiReader(bytes.NewReader(body), req.Body), req.Body}
+		return nil
+	}
+
+	req.Body = ioutil.NopCloser(bytes.NewBuffer(body))
+
+	return body
+}
+
+// createProxy returns the proxy handler, which intercepts the hosts of the host rules with the session's CA
+func (s *Session) createProxy() (*goproxy.ProxyHttpServer, error) {
+	ca, err := s.loadCAKeys()
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
+	mitmConnect := &goproxy.ConnectAction{Action: goproxy.ConnectMitm, TLSConfig: goproxy.TLSConfigFromCA(ca)}
 
 	proxy := goproxy.NewProxyHttpServer()
 	proxy.Logger = log.New(io.Discard, "", log.LstdFlags)
-	proxy.OnRequest(goproxy.ReqHostMatches(regexp.MustCompile(`(?:.*\.amazonaws\.com(?:\.cn)?)|(?:management\.azure\.com)|(?:management\.core\.windows\.net)|(?:.*\.googleapis\.com)`))).HandleConnect(goproxy.AlwaysMitm)
+	err = s.setUpstreamProxy(proxy, s.options.BindAddr)
+	if err != nil {
+		return nil, err
+	}
+	proxy.OnRequest(goproxy.ReqConditionFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) bool {
+		rule := s.matchHostRule(req.Host, "https")
+		return rule != nil && rule.Action == "mitm"
+	})).HandleConnect(goproxy.FuncHttpsHandler(func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+		return mitmConnect, host
+	}))
 	//proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
 	proxy.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) { // TODO: Move to onResponse for HTTP response codes
-		var body []byte
+		rule := s.matchHostRule(req.Host, getRequestScheme(req))
+		if rule == nil || rule.Action != "mitm" || rule.Provider == "" || !s.isProviderEnabled(rule.Provider) {
+			return req, nil
+		}
 
-		isAWSHostname, _ := regexp.MatchString(`^.*\.amazonaws\.com(?:\.cn)?$`, req.Host)
-		isAzureHostname, _ := regexp.MatchString(`^(?:management\.azure\.com)|(?:management\.core\.windows\.net)$`, req.Host)
-		isGCPHostname, _ := regexp.MatchString(`^.*\.googleapis\.com$`, req.Host)
+		body := s.readRequestBody(req)
+		if s.options.Debug {
+			dumpReq(req, body)
+		}
 
-		if isAWSHostname && *providerFlag == "aws" {
-			if *debugFlag {
-				dumpReq(req)
-			}
-			body, _ = ioutil.ReadAll(req.Body)
-			handleAWSRequest(req, body, 200)
+		providerReq := getProviderRequest(req, rule)
 
-			if awsRedirectHost != "" {
-				req.URL.Host = awsRedirectHost
-				req.Host = awsRedirectHost
-			}
-		} else if isAzureHostname && *providerFlag == "azure" {
-			if *debugFlag {
-				dumpReq(req)
+		switch rule.Provider {
+		case "aws":
+			if body == nil && req.Body != nil && req.Body != http.NoBody && isAWSChunkedRequest(req) {
+				// record once the upload has streamed through so trailing checksums are known
+				req.Body = newAWSChunkedReader(req.Body, func(trailer http.Header) {
+					providerReq.Trailer = trailer
+					s.handleAWSRequest(providerReq, nil, 200)
+				})
+			} else {
+				s.handleAWSRequest(providerReq, body, 200)
 			}
-			body, _ = ioutil.ReadAll(req.Body)
-			handleAzureRequest(req, body, 200)
-		} else if isGCPHostname && *providerFlag == "gcp" {
-			if *debugFlag {
-				dumpReq(req)
+
+			if s.options.AWSRedirectHost != "" {
+				req.URL.Host = s.options.AWSRedirectHost
+				req.Host = s.options.AWSRedirectHost
 			}
-			body, _ = ioutil.ReadAll(req.Body)
-			handleGCPRequest(req, body, 200)
-		} else {
-			return req, nil
+		case "azure":
+			s.handleAzureRequest(providerReq, body, 200)
+		case "gcp":
+			s.handleGCPRequest(providerReq, body, 200)
 		}
 
-		req.Body = ioutil.NopCloser(bytes.NewBuffer(body))
-
 		return req, nil
 	})
-	log.Fatal(http.ListenAndServe(addr, proxy))
+
+	return proxy, nil
 }
 
 type ServiceDefinition struct {
@@ -231,12 +298,18 @@ type ServiceDefinition struct {
 	Metadata   ServiceDefinitionMetadata   `json:"metadata"`
 	Operations map[string]ServiceOperation `json:"operations"`
 	Shapes     map[string]ServiceStructure `json:"shapes"`
+	IsLatest   bool                        `json:"-"` // the latest embedded version of the service
 }
 
 type ServiceOperation struct {
-	Http   ServiceHttp      `json:"http"`
-	Input  ServiceStructure `json:"input"`
-	Output ServiceStructure `json:"output"`
+	Http     ServiceHttp      `json:"http"`
+	Input    ServiceStructure `json:"input"`
+	Output   ServiceStructure `json:"output"`
+	Endpoint ServiceEndpoint  `json:"endpoint"`
+}
+
+type ServiceEndpoint struct {
+	HostPrefix string `json:"hostPrefix"`
 }
 
 type ServiceHttp struct {
@@ -253,19 +326,23 @@ type ServiceStructure struct {
 	Members      map[string]ServiceStructure `json:"members"`
 	LocationName string                      `json:"locationName"`
 	QueryName    string                      `json:"queryName"`
+	Payload      string                      `json:"payload"`
+	Streaming    bool                        `json:"streaming"`
 }
 
 type ServiceDefinitionMetadata struct {
-	APIVersion          string `json:"apiVersion"`
-	EndpointPrefix      string `json:"endpointPrefix"`
-	JSONVersion         string `json:"jsonVersion"`
-	Protocol            string `json:"protocol"`
-	ServiceFullName     string `json:"serviceFullName"`
-	ServiceAbbreviation string `json:"serviceAbbreviation"`
-	ServiceID           string `json:"serviceId"`
-	SignatureVersion    string `json:"signatureVersion"`
-	TargetPrefix        string `json:"targetPrefix"`
-	UID                 string `json:"uid"`
+	APIVersion          string   `json:"apiVersion"`
+	EndpointPrefix      string   `json:"endpointPrefix"`
+	JSONVersion         string   `json:"jsonVersion"`
+	Protocol            string   `json:"protocol"`
+	Protocols           []string `json:"protocols"`
+	ServiceFullName     string   `json:"serviceFullName"`
+	ServiceAbbreviation string   `json:"serviceAbbreviation"`
+	ServiceID           string   `json:"serviceId"`
+	SignatureVersion    string   `json:"signatureVersion"`
+	SigningName         string   `json:"signingName"`
+	TargetPrefix        string   `json:"targetPrefix"`
+	UID                 string   `json:"uid"`
 }
 
 type AzureTemplate struct {
@@ -305,92 +382,101 @@ type GCPMethodDefinition struct {
 	ID         string `json:"id"`
 }
 
-func readServiceFiles() {
-	if *providerFlag == "aws" {
-		serviceDirs, err := serviceFiles.ReadDir("apis")
-		if err != nil {
-			panic(err)
+// readServiceFiles loads the API definitions of the enabled providers
+func (s *Session) readServiceFiles() error {
+	if s.isProviderEnabled("aws") {
+		serviceDefinitionsOnce.Do(func() {
+			serviceDefinitionsErr = loadServiceDefinitions()
+		})
+		if serviceDefinitionsErr != nil {
+			return serviceDefinitionsErr
+		}
+	}
+	if s.isProviderEnabled("gcp") {
+		gcpServiceDefinitionsOnce.Do(func() {
+			gcpServiceDefinitionsErr = loadGCPServiceDefinitions()
+		})
+		if gcpServiceDefinitionsErr != nil {
+			return gcpServiceDefinitionsErr
 		}
+	}
 
-		for _, serviceEntry := range serviceDirs {
-			versionDirs, err := serviceFiles.ReadDir("apis/" + serviceEntry.Name())
-			if err != nil {
-				panic(err)
-			}
+	return nil
+}
 
-			latestDir := ""
-			for _, versionEntry := range versionDirs {
-				if latestDir == "" || versionEntry.Name() > latestDir {
-					latestDir = versionEntry.Name()
-				}
-			}
+func loadServiceDefinitions() error {
+	serviceDirs, err := serviceFiles.ReadDir("apis")
+	if err != nil {
+		return err
+	}
 
-			file, err := serviceFiles.Open("apis/" + serviceEntry.Name() + "/" + latestDir + "/api-2.json")
-			if err != nil {
-				panic(err)
-			}
+	for _, serviceEntry := range serviceDirs {
+		versionDirs, err := serviceFiles.ReadDir("apis/" + serviceEntry.Name())
+		if err != nil {
+			return err
+		}
 
-			data, err := ioutil.ReadAll(file)
+		for i, versionEntry := range versionDirs { // sorted, so the last is the latest
+			path := "apis/" + serviceEntry.Name() + "/" + versionEntry.Name() + "/api-2.json"
+			data, err := serviceFiles.ReadFile(path)
 			if err != nil {
-				panic(err)
+				return err
 			}
 
 			var def ServiceDefinition
-			if json.Unmarshal(data, &def) != nil {
-				panic(err)
+			if err := json.Unmarshal(data, &def); err != nil {
+				return fmt.Errorf("error parsing %s: %v", path, err)
 			}
+			def.IsLatest = i == len(versionDirs)-1
 
 			serviceDefinitions = append(serviceDefinitions, def)
 		}
 	}
-	if *providerFlag == "gcp" {
-		file, err := gcpServiceFiles.Open("google-api-go-client/api-list.json")
-		if err != nil {
-			panic(err)
-		}
 
-		data, err := ioutil.ReadAll(file)
-		if err != nil {
-			panic(err)
-		}
+	return nil
+}
 
-		var apiList GCPAPIListFile
-		if json.Unmarshal(data, &apiList) != nil {
-			panic(err)
-		}
+func loadGCPServiceDefinitions() error {
+	data, err := gcpServiceFiles.ReadFile("google-api-go-client/api-list.json")
+	if err != nil {
+		return err
+	}
 
-		for _, apiItem := range apiList.Items {
-			version := strings.ToLower(strings.ReplaceAll(apiItem.Version, "_", "/"))
-			if version == "alpha" {
-				version = "v0.alpha"
-			} else if version == "beta" {
-				version = "v0.beta"
-			}
+	var apiList GCPAPIListFile
+	if err := json.Unmarshal(data, &apiList); err != nil {
+		return fmt.Errorf("error parsing the GCP API list: %v", err)
+	}
 
-			file, err := gcpServiceFiles.Open("google-api-go-client/" + strings.ToLower(apiItem.Name) + "/" + version + "/" + strings.ToLower(apiItem.Name) + "-api.json")
-			if err != nil {
-				file, err = gcpServiceFiles.Open("google-api-go-client/" + strings.ToLower(apiItem.Name) + "/" + strings.ToLower(apiItem.Version) + "/" + strings.ToLower(apiItem.Name) + "-api.json")
-				if err != nil {
-					panic(err)
-				}
-			}
+	for _, apiItem := range apiList.Items {
+		version := strings.ToLower(strings.ReplaceAll(apiItem.Version, "_", "/"))
+		if version == "alpha" {
+			version = "v0.alpha"
+		} else if version == "beta" {
+			version = "v0.beta"
+		}
 
-			data, err := ioutil.ReadAll(file)
+		path := "google-api-go-client/" + strings.ToLower(apiItem.Name) + "/" + version + "/" + strings.ToLower(apiItem.Name) + "-api.json"
+		data, err := gcpServiceFiles.ReadFile(path)
+		if err != nil {
+			path = "google-api-go-client/" + strings.ToLower(apiItem.Name) + "/" + strings.ToLower(apiItem.Version) + "/" + strings.ToLower(apiItem.Name) + "-api.json"
+			data, err = gcpServiceFiles.ReadFile(path)
 			if err != nil {
-				panic(err)
+				return err
 			}
+		}
 
-			var def GCPServiceDefinition
-			if json.Unmarshal(data, &def) != nil {
-				panic("bad json")
-			}
+		var def GCPServiceDefinition
+		if err := json.Unmarshal(data, &def); err != nil {
+			return fmt.Errorf("error parsing %s: %v", path, err)
+		}
 
-			url, _ := url.Parse(def.RootURL)
-			def.RootDomain = url.Hostname()
+		url, _ := url.Parse(def.RootURL)
+		def.RootDomain = url.Hostname()
 
-			gcpServiceDefinitions = append(gcpServiceDefinitions, def)
-		}
+		gcpServiceDefinitions = append(gcpServiceDefinitions, def)
 	}
+
+	return nil
 }
 
 func flatten(top bool, flatMap map[string][]string, nested interface{}, prefix string) error {
@@ -427,6 +513,81 @@ func flatten(top bool, flatMap map[string][]string, nested interface{}, prefix s
 	return nil
 }
 
+// getServiceDefinitionCandidates returns the definitions for an endpoint prefix, choosing between the embedded API
+// versions using the Version parameter or X-Amz-Target prefix of the request where present
+func getServiceDefinitionCandidates(endpointPrefix string, req *http.Request, body []byte) []ServiceDefinition {
+	targetPrefix := ""
+	amzTargetHeader := req.Header.Get("X-Amz-Target")
+	if targetSeparator := strings.LastIndex(amzTargetHeader, "."); targetSeparator > 0 {
+		targetPrefix = amzTargetHeader[:targetSeparator]
+	}
+
+	requestedVersion := req.URL.Query().Get("Version")
+	if requestedVersion == "" && strings.Contains(strings.ToLower(req.Header.Get("Content-Type")), "x-www-form-urlencoded") {
+		vals, err := url.ParseQuery(string(body))
+		if err == nil {
+			requestedVersion = vals.Get("Version")
+		}
+	}
+
+	versionMatches := []ServiceDefinition{}
+	latest := []ServiceDefinition{}
+	older := []ServiceDefinition{}
+	for _, serviceDefinition := range serviceDefinitions {
+		if serviceDefinition.Metadata.EndpointPrefix != endpointPrefix {
+			continue
+		}
+
+		isQuery := serviceDefinition.Metadata.Protocol == "query" || serviceDefinition.Metadata.Protocol == "ec2"
+		if (targetPrefix != "" && serviceDefinition.Metadata.TargetPrefix == targetPrefix) || (isQuery && requestedVersion != "" && serviceDefinition.Metadata.APIVersion == requestedVersion) {
+			versionMatches = append(versionMatches, serviceDefinition)
+		}
+
+		if serviceDefinition.IsLatest {
+			latest = append(latest, serviceDefinition)
+		} else if strings.HasPrefix(serviceDefinition.Metadata.Protocol, "rest-") { // versioned paths, e.g. /2019-03-26/distribution
+			older = append(older, serviceDefinition)
+		}
+	}
+
+	if len(versionMatches) > 0 {
+		return versionMatches
+	}
+
+	sort.SliceStable(older, func(i, j int) bool {
+		return older[i].Metadata.APIVersion > older[j].Metadata.APIVersion
+	})
+
+	return append(latest, older...)
+}
+
+var rpcv2PathRegex = regexp.MustCompile(`/service/([^/]+)/operation/([^/]+)$`)
+
+// getRequestProtocol picks which of the protocols supported by the service the request was sent with
+func getRequestProtocol(req *http.Request, metadata ServiceDefinitionMetadata) string {
+	if len(metadata.Protocols) == 0 {
+		return metadata.Protocol
+	}
+
+	detected := ""
+	contentType := strings.ToLower(req.Header.Get("Content-Type"))
+	if req.Header.Get("Smithy-Protocol") == "rpc-v2-cbor" || (strings.Contains(contentType, "cbor") && rpcv2PathRegex.MatchString(req.URL.Path)) {
+		detected = "smithy-rpc-v2-cbor"
+	} else if req.Header.Get("X-Amz-Target") != "" {
+		detected = "json"
+	} else if strings.Contains(contentType, "x-www-form-urlencoded") {
+		detected = "query"
+	}
+
+	for _, protocol := range metadata.Protocols {
+		if protocol == detected || (detected == "query" && protocol == "ec2") {
+			return protocol
+		}
+	}
+
+	return metadata.Protocol
+}
+
 type ActionCandidate struct {
 	Path      string
 	Action    string
@@ -434,46 +595,172 @@ type ActionCandidate struct {
 	Params    map[string][]string
 	Operation ServiceOperation
 	Service   string
+
+	Metadata        ServiceDefinitionMetadata
+	RequirementsMet bool // false when chosen only as a last resort
+}
+
+// awsServiceNameAliases renames the SDK service names derived from API definitions to those used by the mappings,
+// entries in the sdk_service_name_aliases key of the mapping file take precedence
+var awsServiceNameAliases = map[string]string{
+	"ElasticLoadBalancing":          "ELB",
+	"ElasticLoadBalancingv2":        "ELBv2",
+	"CognitoIdentityProvider":       "CognitoIdentityServiceProvider",
+	"AgentsforAmazonBedrockRuntime": "BedrockAgentRuntime",
+}
+
+// getSDKServiceName returns the service name the SDKs derive from an API definition, before aliasing
+func getSDKServiceName(metadata ServiceDefinitionMetadata) string {
+	// Doc: https://github.com/aws/aws-sdk-js/blob/54f8555bd94d33a1754a44a35286f1d9e31c28a3/lib/model/api.js#L41
+	service := metadata.ServiceAbbreviation
+	if service == "" {
+		service = metadata.ServiceFullName
+	}
+	return regexp.MustCompile(`(^Amazon|AWS\s*|\(.*|\s+|\W+)`).ReplaceAllString(service, "")
+}
+
+func (s *Session) getAWSServiceName(metadata ServiceDefinitionMetadata) string {
+	service := getSDKServiceName(metadata)
+
+	if alias, ok := s.iamMap.SDKServiceNameAliases[service]; ok {
+		return alias
+	}
+	if alias, ok := awsServiceNameAliases[service]; ok {
+		return alias
+	}
+
+	return service
 }
 
-func handleAWSRequest(req *http.Request, body []byte, respCode int) {
+// getSigV4CredentialScope returns the region and signing name from the SigV4 credential scope of the request
+func getSigV4CredentialScope(req *http.Request) (string, string) {
+	credential := ""
+
+	authHeader := req.Header.Get("Authorization")
+	credOffset := strings.Index(authHeader, "Credential=")
+	if credOffset > -1 {
+		credential = strings.Split(authHeader[credOffset+len("Credential="):], ",")[0]
+	} else {
+		credential = req.URL.Query().Get("X-Amz-Credential")
+	}
+
+	scope := strings.Split(credential, "/") // AKID/date/region/service/aws4_request
+	if len(scope) != 5 {
+		return "", ""
+	}
+
+	return scope[2], scope[3]
+}
+
+// selectServiceActionCandidate breaks ties between services sharing an endpoint prefix using the signing name, the
+// X-Amz-Target prefix and how well the operation matched
+func selectServiceActionCandidate(candidates []ActionCandidate, req *http.Request) (ActionCandidate, bool) {
+	_, signingName := getSigV4CredentialScope(req)
+
+	targetPrefix := ""
+	amzTargetHeader := req.Header.Get("X-Amz-Target")
+	if targetSeparator := strings.LastIndex(amzTargetHeader, "."); targetSeparator > 0 {
+		targetPrefix = amzTargetHeader[:targetSeparator]
+	}
+
+	score := func(candidate ActionCandidate) int {
+		candidateScore := 0
+		if candidate.RequirementsMet {
+			candidateScore += 8
+		}
+		candidateSigningName := candidate.Metadata.SigningName
+		if candidateSigningName == "" {
+			candidateSigningName = candidate.Metadata.EndpointPrefix
+		}
+		if signingName != "" && candidateSigningName == signingName {
+			candidateScore += 4
+		}
+		if targetPrefix != "" && candidate.Metadata.TargetPrefix == targetPrefix {
+			candidateScore += 2
+		}
+		if strings.HasPrefix(candidate.Metadata.UID, candidate.Metadata.EndpointPrefix+"-") { // the service the prefix is named after
+			candidateScore++
+		}
+		return candidateScore
+	}
+
+	selected := -1
+	selectedScore := -1
+	for i, candidate := range candidates {
+		candidateScore := score(candidate)
+		if candidateScore > selectedScore || (candidateScore == selectedScore && len(candidate.Path) > len(candidates[selected].Path)) {
+			selected = i
+			selectedScore = candidateScore
+		}
+	}
+
+	if selected == -1 {
+		return ActionCandidate{}, false
+	}
+
+	return candidates[selected], true
+}
+
+func (s *Session) handleAWSRequest(req *http.Request, body []byte, respCode int) {
 	host := req.Host
 	host = strings.TrimSuffix(host, ".cn")
-	uri := req.RequestURI
+
+	if entry, ok := getAWSDataPlaneEntry(req, host, respCode); ok { // API Gateway and Lambda function URLs
+		s.mu.Lock()
+		s.callLog = append(s.callLog, entry)
+		s.mu.Unlock()
+		s.publishCall(CallEvent{Provider: "aws", AWS: &entry})
+		s.handleLoggedCall()
+		return
+	}
 
 	var endpointUriPrefix string
-	var service string
 
-	var serviceDef ServiceDefinition
 	hostSplit := strings.Split(host, ".")
+	if len(hostSplit) < 3 {
+		return
+	}
 
-	uriparams := make(map[string]string)
-	params := make(map[string][]string)
-	action := ""
-	actionMatch := false
-	var selectedCandidate ActionCandidate
-
-	if len(hostSplit) == 4 {
-		if hostSplit[0] == "s3express-control" {
-			hostSplit[0] = "s3"
+	trailer := req.Trailer
+	if isAWSChunkedRequest(req) && len(body) > 0 {
+		payload, chunkTrailer, err := decodeAWSChunked(body)
+		if err == nil {
+			body = payload
+			trailer = chunkTrailer
 		}
 	}
 
-	if strings.HasPrefix(hostSplit[len(hostSplit)-3], "s3-") { // bucketname."s3-us-west-2".amazonaws.com
-		hostSplit[len(hostSplit)-3] = hostSplit[len(hostSplit)-3][3:]    // strip s3-
-		hostSplit = append(hostSplit, "")                                // make room
-		copy(hostSplit[len(hostSplit)-3:], hostSplit[len(hostSplit)-4:]) // shift over
-		hostSplit[len(hostSplit)-4] = "s3"                               // insert s3
-	}
+	var endpointPrefix string
+	s3Endpoint := parseS3Endpoint(host)
 
-	if len(hostSplit) == 5 {
-		if strings.HasPrefix(hostSplit[1], "s3express-") { // bucketname--usw2-az1--x-s3."s3express-usw2-az1".ap-southeast-2.amazonaws.com
-			hostSplit[1] = "s3"
+	if s3Endpoint != nil { // access points, Outposts, Object Lambda and S3 Control
+		endpointPrefix = s3Endpoint.endpointPrefix
+		endpointUriPrefix = s3Endpoint.endpointUriPrefix
+	} else {
+		if len(hostSplit) == 4 {
+			if hostSplit[0] == "s3express-control" {
+				hostSplit[0] = "s3"
+			}
 		}
-	}
 
-	if hostSplit[len(hostSplit)-1] == "com" && hostSplit[len(hostSplit)-2] == "amazonaws" {
-		endpointPrefix := hostSplit[len(hostSplit)-3] // "s3".amazonaws.com
+		if strings.HasPrefix(hostSplit[len(hostSplit)-3], "s3-") { // bucketname."s3-us-west-2".amazonaws.com
+			hostSplit[len(hostSplit)-3] = hostSplit[len(hostSplit)-3][3:]    // strip s3-
+			hostSplit = append(hostSplit, "")                                // make room
+			copy(hostSplit[len(hostSplit)-3:], hostSplit[len(hostSplit)-4:]) // shift over
+			hostSplit[len(hostSplit)-4] = "s3"                               // insert s3
+		}
+
+		if len(hostSplit) == 5 {
+			if strings.HasPrefix(hostSplit[1], "s3express-") { // bucketname--usw2-az1--x-s3."s3express-usw2-az1".ap-southeast-2.amazonaws.com
+				hostSplit[1] = "s3"
+			}
+		}
+
+		if hostSplit[len(hostSplit)-1] != "com" || hostSplit[len(hostSplit)-2] != "amazonaws" {
+			return
+		}
+
+		endpointPrefix = hostSplit[len(hostSplit)-3] // "s3".amazonaws.com
 		if endpointPrefix == "s3" && len(hostSplit) > 3 {
 			endpointUriPrefix = strings.Join(hostSplit[:len(hostSplit)-3], ".") // "bucket.name".s3.amazonaws.com
 		} else {
@@ -493,341 +780,400 @@ func handleAWSRequest(req *http.Request, body []byte, respCode int) {
 				}
 			}
 		}
+	}
 
-		for _, serviceDefinition := range serviceDefinitions {
-			if serviceDefinition.Metadata.EndpointPrefix == endpointPrefix { // TODO: Ensure latest version
-				serviceDef = serviceDefinition
+	candidates := []ActionCandidate{}
+	for _, serviceDefinition := range getServiceDefinitionCandidates(endpointPrefix, req, body) {
+		candidate, ok := s.getServiceActionCandidate(serviceDefinition, req, body, trailer, endpointUriPrefix)
+		if ok {
+			candidates = append(candidates, candidate)
+		}
+	}
 
-				// Doc: https://github.com/aws/aws-sdk-js/blob/54f8555bd94d33a1754a44a35286f1d9e31c28a3/lib/model/api.js#L41
-				service = serviceDef.Metadata.ServiceAbbreviation
-				if service == "" {
-					service = serviceDef.Metadata.ServiceFullName
-				}
-				service = regexp.MustCompile(`(^Amazon|AWS\s*|\(.*|\s+|\W+)`).ReplaceAllString(service, "")
-				if service == "ElasticLoadBalancing" || service == "ElasticLoadBalancingv2" {
-					service = "ELB"
-				}
-				if service == "CognitoIdentityProvider" {
-					service = "CognitoIdentityServiceProvider"
-				}
-				if service == "AgentsforAmazonBedrockRuntime" {
-					service = "BedrockAgentRuntime"
-				}
+	selectedCandidate, ok := selectServiceActionCandidate(candidates, req)
+	if !ok {
+		s.mu.Lock()
+		s.unrecognizedCallLog = append(s.unrecognizedCallLog, unrecognizedEntry{
+			HTTPMethod:          req.Method,
+			Host:                host,
+			Path:                req.URL.Path,
+			FinalHTTPStatusCode: respCode,
+		})
+		s.mu.Unlock()
+		if s.options.Coverage {
+			s.handleLoggedCall()
+		}
+		return
+	}
 
-				if serviceDef.Metadata.Protocol == "json" {
-					// JSON schema
-					var bodyJSON interface{}
-					err := json.Unmarshal(body, &bodyJSON)
+	region := "us-east-1"
+	re, _ := regexp.Compile(`\.([^.]+)\.amazonaws\.com(?:\.cn)?$`)
+	matches := re.FindStringSubmatch(host)
+	if len(matches) == 2 {
+		if matches[1] != "s3" { // https://docs.aws.amazon.com/AmazonS3/latest/userguide/VirtualHosting.html#VirtualHostingBackwardsCompatibility
+			region = matches[1]
+		}
+	}
+	if s3Endpoint != nil && s3Endpoint.region != "" {
+		region = s3Endpoint.region
+	}
 
-					if err == nil {
-						amzTargetHeader := req.Header.Get("X-Amz-Target")
-						if amzTargetHeader != "" {
-							action = strings.Split(amzTargetHeader, ".")[1]
-							flatten(true, params, bodyJSON, "")
-						} else {
-							return
-						}
-					} else {
-						return
-					}
-				} else if serviceDef.Metadata.Protocol == "ec2" || serviceDef.Metadata.Protocol == "query" {
-					// URL param schema in body
-					vals, err := url.ParseQuery(string(body))
-					if err != nil {
-						return
-					}
+	if s3Endpoint != nil && s3Endpoint.accessPointArn != "" && selectedCandidate.URIParams["Bucket"] == s3Endpoint.endpointUriPrefix {
+		accessPointArn := strings.ReplaceAll(s3Endpoint.accessPointArn, "${Partition}", getPartitionFromRegion(region))
+		if !strings.Contains(accessPointArn, "${") { // the account of Multi-Region Access Points is resolved with the policy
+			selectedCandidate.URIParams["Bucket"] = accessPointArn // as passed to the SDK
+		}
+	}
 
-					if len(vals["Action"]) != 1 || len(vals["Version"]) != 1 {
-						return
-					}
-					action = vals["Action"][0]
-					if service == "ELB" && vals["Version"][0] != "2012-06-01" { // exception
-						service = "ELBv2"
-						for _, serviceDefinition := range serviceDefinitions {
-							if serviceDefinition.Metadata.ServiceAbbreviation == "Elastic Load Balancing v2" {
-								serviceDef = serviceDefinition
-							}
-						}
-					}
+	// attempt to determine access key and/or session token from auth header
+	accessKey, sessionToken := getAWSCallCredentials(req)
 
-					if serviceDef.Operations[action].Input.Type == "structure" {
-						for k, v := range vals {
-							if k != "Action" && k != "Version" {
-								normalizedK := regexp.MustCompile(`\.member\.[0-9]+`).ReplaceAllString(k, "[]")
-								normalizedK = regexp.MustCompile(`\.[0-9]+`).ReplaceAllString(normalizedK, "[]")
-
-								resolvedPropertyName := resolvePropertyName(serviceDef.Operations[action].Input, normalizedK, "", "", serviceDef.Shapes)
-								if resolvedPropertyName != "" {
-									normalizedK = resolvedPropertyName
-								}
-
-								if len(params[normalizedK]) > 0 {
-									params[normalizedK] = append(params[normalizedK], v...)
-								} else {
-									params[normalizedK] = v
-								}
-							}
-						}
+	entry := Entry{
+		Region:              region,
+		Type:                "ProxyCall",
+		Timestamp:           time.Now().UnixMilli(),
+		Service:             selectedCandidate.Service,
+		Method:              selectedCandidate.Action,
+		Parameters:          selectedCandidate.Params,
+		URIParameters:       selectedCandidate.URIParams,
+		FinalHTTPStatusCode: respCode,
+		AccessKey:           accessKey,
+		SessionToken:        sessionToken,
+		Host:                host,
+	}
+
+	s.mu.Lock()
+	s.callLog = append(s.callLog, entry)
+	s.mu.Unlock()
+	s.publishCall(CallEvent{Provider: "aws", AWS: &entry})
+
+	s.handleLoggedCall()
+}
+
+// getServiceActionCandidate parses the request against a single service definition
+func (s *Session) getServiceActionCandidate(serviceDef ServiceDefinition, req *http.Request, body []byte, trailer http.Header, endpointUriPrefix string) (ActionCandidate, bool) {
+	uri := req.RequestURI
+	params := make(map[string][]string)
+	action := ""
+	service := s.getAWSServiceName(serviceDef.Metadata)
+
+	protocol := getRequestProtocol(req, serviceDef.Metadata)
+
+	if protocol == "json" {
+		// JSON schema
+		amzTargetHeader := req.Header.Get("X-Amz-Target")
+		targetSeparator := strings.LastIndex(amzTargetHeader, ".")
+		if targetSeparator == -1 {
+			return ActionCandidate{}, false
+		}
+		action = amzTargetHeader[targetSeparator+1:]
+		if _, ok := serviceDef.Operations[action]; !ok {
+			return ActionCandidate{}, false
+		}
+
+		if len(body) > 0 {
+			var bodyJSON interface{}
+			err := json.Unmarshal(body, &bodyJSON)
+			if err != nil {
+				return ActionCandidate{}, false
+			}
+
+			flatten(true, params, bodyJSON, "")
+		}
+	} else if protocol == "smithy-rpc-v2-cbor" {
+		// Doc: https://smithy.io/2.0/additional-specs/protocols/smithy-rpc-v2.html
+		pathMatches := rpcv2PathRegex.FindStringSubmatch(req.URL.Path)
+		if len(pathMatches) != 3 {
+			return ActionCandidate{}, false
+		}
+		action = pathMatches[2]
+		if _, ok := serviceDef.Operations[action]; !ok {
+			return ActionCandidate{}, false
+		}
+
+		if len(body) > 0 {
+			bodyCBOR, err := decodeCBOR(body)
+			if err != nil {
+				return ActionCandidate{}, false
+			}
+
+			flatten(true, params, bodyCBOR, "")
+		}
+	} else if protocol == "ec2" || protocol == "query" {
+		// URL param schema in body
+		vals, err := url.ParseQuery(string(body))
+		if err != nil {
+			return ActionCandidate{}, false
+		}
+
+		if len(vals["Action"]) != 1 || len(vals["Version"]) != 1 {
+			return ActionCandidate{}, false
+		}
+		action = vals["Action"][0]
+		if _, ok := serviceDef.Operations[action]; !ok {
+			return ActionCandidate{}, false
+		}
+
+		if serviceDef.Shapes[serviceDef.Operations[action].Input.Shape].Type == "structure" {
+			for k, v := range vals {
+				if k != "Action" && k != "Version" {
+					normalizedK := regexp.MustCompile(`\.member\.[0-9]+`).ReplaceAllString(k, "[]")
+					normalizedK = regexp.MustCompile(`\.[0-9]+`).ReplaceAllString(normalizedK, "[]")
+
+					resolvedPropertyName := resolvePropertyName(serviceDef.Operations[action].Input, normalizedK, "", "", serviceDef.Shapes)
+					if resolvedPropertyName != "" {
+						normalizedK = resolvedPropertyName
 					}
-				} else if serviceDef.Metadata.Protocol == "rest-json" || serviceDef.Metadata.Protocol == "rest-xml" {
-					// URL param schema
-					urlobj, err := url.ParseRequestURI(uri)
-					if err != nil {
-						return
+
+					if len(params[normalizedK]) > 0 {
+						params[normalizedK] = append(params[normalizedK], v...)
+					} else {
+						params[normalizedK] = v
 					}
-					vals := urlobj.Query()
-
-					actionCandidates := []ActionCandidate{}
-
-					// path part
-				OperationLoop:
-					for operationName, operation := range serviceDef.Operations {
-						path := urlobj.Path
-						if serviceDef.Metadata.EndpointPrefix == "s3" && strings.HasPrefix(operation.Http.RequestURI, "/{Bucket}") && endpointUriPrefix != "" { // https://docs.aws.amazon.com/AmazonS3/latest/userguide/VirtualHosting.html#VirtualHostingSpecifyBucket
-							if len(urlobj.Path) > 1 {
-								path = "/" + endpointUriPrefix + "/" + urlobj.Path[1:]
-							} else {
-								path = "/" + endpointUriPrefix
-							}
-						}
-						if operation.Http.RequestURI == "" || operation.Http.RequestURI[0] != '/' {
-							operation.Http.RequestURI = "/" + operation.Http.RequestURI
-						}
+				}
+			}
+		}
+	} else if protocol == "rest-json" || protocol == "rest-xml" {
+		// URL param schema
+		urlobj, err := url.ParseRequestURI(uri)
+		if err != nil {
+			return ActionCandidate{}, false
+		}
+		vals := urlobj.Query()
 
-						if strings.Contains(operation.Http.RequestURI, "?") {
-							path += "?"
+		actionCandidates := []ActionCandidate{}
 
-							operationurlobj, err := url.ParseRequestURI(operation.Http.RequestURI)
-							if err != nil {
-								continue
-							}
+		// path part
+	OperationLoop:
+		for operationName, operation := range serviceDef.Operations {
+			path := urlobj.Path
+			if serviceDef.Metadata.EndpointPrefix == "s3" && strings.HasPrefix(operation.Http.RequestURI, "/{Bucket}") && endpointUriPrefix != "" { // https://docs.aws.amazon.com/AmazonS3/latest/userguide/VirtualHosting.html#VirtualHostingSpecifyBucket
+				if len(urlobj.Path) > 1 {
+					path = "/" + endpointUriPrefix + "/" + urlobj.Path[1:]
+				} else {
+					path = "/" + endpointUriPrefix
+				}
+			}
+			if operation.Http.RequestURI == "" || operation.Http.RequestURI[0] != '/' {
+				operation.Http.RequestURI = "/" + operation.Http.RequestURI
+			}
 
-							operationquery := operationurlobj.Query()
-							for operationquerykey, operationqueryvalue := range operationquery {
-								if _, ok := vals[operationquerykey]; ok {
-									if operationqueryvalue[0] == "" {
-										path += operationquerykey + "&"
-									} else if len(vals[operationquerykey]) > 0 {
-										path += operationquerykey + "=" + vals[operationquerykey][0] + "&"
-									} else {
-										continue OperationLoop
-									}
-								} else {
-									continue OperationLoop
-								}
-							}
+			if strings.Contains(operation.Http.RequestURI, "?") {
+				path += "?"
 
-							if path[len(path)-1] == '&' {
-								path = path[:len(path)-1]
-							}
+				operationurlobj, err := url.ParseRequestURI(operation.Http.RequestURI)
+				if err != nil {
+					continue
+				}
+
+				operationquery := operationurlobj.Query()
+				for operationquerykey, operationqueryvalue := range operationquery {
+					if _, ok := vals[operationquerykey]; ok {
+						if operationqueryvalue[0] == "" {
+							path += operationquerykey + "&"
+						} else if len(vals[operationquerykey]) > 0 {
+							path += operationquerykey + "=" + vals[operationquerykey][0] + "&"
+						} else {
+							continue OperationLoop
 						}
+					} else {
+						continue OperationLoop
+					}
+				}
 
-						templateMatches := regexp.MustCompile(`{([^}]+?)\+?}`).FindAllStringSubmatch(operation.Http.RequestURI, -1)
-						regexStr := regexp.MustCompile(`\\{([^}]+?\\\+)\\}`).ReplaceAllString(regexp.QuoteMeta(operation.Http.RequestURI), `([^?]+)`) // {Key+}
-						regexStr = fmt.Sprintf("^%s$", regexp.MustCompile(`\\{(.+?)\\}`).ReplaceAllString(regexStr, `([^/?]+?)`))                     // {Bucket}
-						pathMatchSuccess := regexp.MustCompile(regexStr).Match([]byte(path))
+				if path[len(path)-1] == '&' {
+					path = path[:len(path)-1]
+				}
+			}
 
-						if operation.Http.Method == "" {
-							operation.Http.Method = "POST"
-						}
+			templateMatches := regexp.MustCompile(`{([^}]+?)\+?}`).FindAllStringSubmatch(operation.Http.RequestURI, -1)
+			regexStr := regexp.MustCompile(`\\{([^}]+?\\\+)\\}`).ReplaceAllString(regexp.QuoteMeta(operation.Http.RequestURI), `([^?]+)`) // {Key+}
+			regexStr = fmt.Sprintf("^%s$", regexp.MustCompile(`\\{(.+?)\\}`).ReplaceAllString(regexStr, `([^/?]+?)`))                     // {Bucket}
+			pathMatchSuccess := regexp.MustCompile(regexStr).Match([]byte(path))
 
-						if operation.Http.Method == req.Method && pathMatchSuccess {
-							action = operationName
-							uriparams = map[string]string{}
+			if operation.Http.Method == "" {
+				operation.Http.Method = "POST"
+			}
+			if serviceDef.Metadata.EndpointPrefix == "s3" && len(operation.Input.Required) == 0 { // the requirements live on the input shape, e.g. ListParts vs GetObject
+				operation.Input.Required = serviceDef.Shapes[operation.Input.Shape].Required
+			}
 
-							pathMatches := regexp.MustCompile(regexStr).FindAllStringSubmatch(path, -1)
+			if operation.Http.Method == req.Method && pathMatchSuccess {
+				action = operationName
+				uriparams := map[string]string{}
+				params := map[string][]string{}
 
-							if len(pathMatches) > 0 && len(templateMatches) > 0 && len(templateMatches) == len(pathMatches[0])-1 {
-								for i := 0; i < len(templateMatches); i++ {
-									uriparams[templateMatches[i][1]] = pathMatches[0][1:][i]
-								}
-							}
+				pathMatches := regexp.MustCompile(regexStr).FindAllStringSubmatch(path, -1)
 
-							// query part
-							for k, v := range vals {
-								normalizedK := regexp.MustCompile(`\.member\.[0-9]+`).ReplaceAllString(k, "[]")
-								normalizedK = regexp.MustCompile(`\.[0-9]+`).ReplaceAllString(normalizedK, "[]")
-
-								resolvedPropertyName := resolvePropertyName(serviceDef.Operations[action].Input, normalizedK, "", "", serviceDef.Shapes)
-								if resolvedPropertyName != "" {
-									normalizedK = resolvedPropertyName
-								} else {
-									// continue // Skipping just in case
-								}
-
-								if len(params[normalizedK]) > 0 {
-									params[normalizedK] = append(params[normalizedK], v...)
-								} else {
-									params[normalizedK] = v
-								}
-							}
+				if len(pathMatches) > 0 && len(templateMatches) > 0 && len(templateMatches) == len(pathMatches[0])-1 {
+					for i := 0; i < len(templateMatches); i++ {
+						uriparams[templateMatches[i][1]] = pathMatches[0][1:][i]
+					}
+				}
 
-							// header part
-							for k, v := range req.Header {
-								resolvedPropertyName := resolvePropertyName(serviceDef.Operations[action].Input, k, "", "", serviceDef.Shapes)
-								if resolvedPropertyName != "" {
-									k = resolvedPropertyName
-								} else {
-									continue
-								}
-
-								if len(params[k]) > 0 {
-									params[k] = append(params[k], v...)
-								} else {
-									params[k] = v
-								}
-							}
+				// host part, e.g. {AccountId}.s3-control.us-east-1.amazonaws.com
+				for k, v := range getHostPrefixParams(operation, endpointUriPrefix) {
+					if _, ok := uriparams[k]; !ok {
+						uriparams[k] = v
+					}
+				}
 
-							// body part
-							if len(body) > 0 {
-								if serviceDef.Metadata.Protocol == "rest-json" {
-									var bodyJSON interface{}
-									err := json.Unmarshal(body, &bodyJSON)
-									if err != nil {
-										return
-									}
-
-									flatten(true, params, bodyJSON, "")
-								} else {
-									mxjXML, err := mxj.NewMapXml(body)
-									bodyXML := map[string]interface{}(mxjXML)
-									if err != nil {
-										// last chance effort to parse as JSON
-										err := json.Unmarshal(body, &bodyXML)
-										if err != nil {
-											return
-										}
-									}
-
-									flatten(true, params, bodyXML, "")
-								}
-							}
+				// query part
+				for k, v := range vals {
+					normalizedK := regexp.MustCompile(`\.member\.[0-9]+`).ReplaceAllString(k, "[]")
+					normalizedK = regexp.MustCompile(`\.[0-9]+`).ReplaceAllString(normalizedK, "[]")
 
-							actionCandidates = append(actionCandidates, ActionCandidate{
-								Path:      path,
-								Action:    action,
-								Params:    params,
-								URIParams: uriparams,
-								Operation: operation,
-								Service:   service,
-							})
-						}
+					resolvedPropertyName := resolvePropertyName(serviceDef.Operations[action].Input, normalizedK, "", "", serviceDef.Shapes)
+					if resolvedPropertyName != "" {
+						normalizedK = resolvedPropertyName
+					} else {
+						// continue // Skipping just in case
 					}
 
-					// select candidate
-					var selectedActionCandidate ActionCandidate
-				ActionCandidateLoop:
-					for _, actionCandidate := range actionCandidates {
-					RequiredParamLoop:
-						for _, requiredParam := range actionCandidate.Operation.Input.Required { // check input requirements
-							for k := range actionCandidate.Params {
-								if k == requiredParam || (len(k) >= len(requiredParam)+2 && k[:len(requiredParam)+2] == requiredParam+"[]") || (len(k) >= len(requiredParam)+1 && k[:len(requiredParam)+1] == requiredParam+".") { // equals, or is array, or is map
-									continue RequiredParamLoop
-								}
-							}
-							for k := range actionCandidate.URIParams {
-								if k == requiredParam || (len(k) >= len(requiredParam)+2 && k[:len(requiredParam)+2] == requiredParam+"[]") || (len(k) >= len(requiredParam)+1 && k[:len(requiredParam)+1] == requiredParam+".") { // equals, or is array, or is map
-									continue RequiredParamLoop
-								}
-							}
-							continue ActionCandidateLoop // requirements not met
-						}
-						if selectedActionCandidate.Action == "" { // first one
-							selectedActionCandidate = actionCandidate
-							continue
-						}
-						if len(actionCandidate.Path) > len(selectedActionCandidate.Path) { // longer path wins
-							selectedActionCandidate = actionCandidate
+					if len(params[normalizedK]) > 0 {
+						params[normalizedK] = append(params[normalizedK], v...)
+					} else {
+						params[normalizedK] = v
+					}
+				}
+
+				// header part, including any aws-chunked trailers
+				for _, headers := range []http.Header{req.Header, trailer} {
+					for k, v := range headers {
+						resolvedPropertyName := resolvePropertyName(serviceDef.Operations[action].Input, k, "", "", serviceDef.Shapes)
+						if resolvedPropertyName != "" {
+							k = resolvedPropertyName
+						} else {
 							continue
 						}
-						if len(actionCandidate.Operation.Input.Required) > len(selectedActionCandidate.Operation.Input.Required) { // more requirements wins
-							selectedActionCandidate = actionCandidate
-							continue
+
+						if len(params[k]) > 0 {
+							params[k] = append(params[k], v...)
+						} else {
+							params[k] = v
 						}
 					}
+				}
 
-					if !actionMatch && selectedActionCandidate.Action != "" {
-						selectedCandidate = selectedActionCandidate
-						actionMatch = true
+				// body part
+				if len(body) > 0 && !hasBlobPayload(serviceDef.Operations[action].Input, serviceDef.Shapes) {
+					if protocol == "rest-json" {
+						var bodyJSON interface{}
+						err := json.Unmarshal(body, &bodyJSON)
+						if err != nil {
+							return ActionCandidate{}, false
+						}
+
+						flatten(true, params, bodyJSON, "")
+					} else {
+						mxjXML, err := mxj.NewMapXml(body)
+						bodyXML := map[string]interface{}(mxjXML)
+						if err != nil {
+							// last chance effort to parse as JSON
+							err := json.Unmarshal(body, &bodyXML)
+							if err != nil {
+								return ActionCandidate{}, false
+							}
+						}
+
+						flatten(true, params, bodyXML, "")
 					}
 				}
+
+				actionCandidates = append(actionCandidates, ActionCandidate{
+					Path:            path,
+					Action:          action,
+					Params:          params,
+					URIParams:       uriparams,
+					Operation:       operation,
+					Service:         service,
+					Metadata:        serviceDef.Metadata,
+					RequirementsMet: true,
+				})
 			}
 		}
-	} else {
-		return
-	}
-
-	if action == "" {
-		return
-	}
 
-	region := "us-east-1"
-	re, _ := regexp.Compile(`\.([^.]+)\.amazonaws\.com(?:\.cn)?$`)
-	matches := re.FindStringSubmatch(host)
-	if len(matches) == 2 {
-		if matches[1] != "s3" { // https://docs.aws.amazon.com/AmazonS3/latest/userguide/VirtualHosting.html#VirtualHostingBackwardsCompatibility
-			region = matches[1]
+		// select candidate
+		var selectedActionCandidate ActionCandidate
+		var fallbackActionCandidate ActionCandidate
+	ActionCandidateLoop:
+		for _, actionCandidate := range actionCandidates {
+		RequiredParamLoop:
+			for _, requiredParam := range actionCandidate.Operation.Input.Required { // check input requirements
+				for k := range actionCandidate.Params {
+					if k == requiredParam || (len(k) >= len(requiredParam)+2 && k[:len(requiredParam)+2] == requiredParam+"[]") || (len(k) >= len(requiredParam)+1 && k[:len(requiredParam)+1] == requiredParam+".") { // equals, or is array, or is map
+						continue RequiredParamLoop
+					}
+				}
+				for k := range actionCandidate.URIParams {
+					if k == requiredParam || (len(k) >= len(requiredParam)+2 && k[:len(requiredParam)+2] == requiredParam+"[]") || (len(k) >= len(requiredParam)+1 && k[:len(requiredParam)+1] == requiredParam+".") { // equals, or is array, or is map
+						continue RequiredParamLoop
+					}
+				}
+				actionCandidate.RequirementsMet = false
+				if fallbackActionCandidate.Action == "" {
+					fallbackActionCandidate = actionCandidate
+				}
+				continue ActionCandidateLoop // requirements not met
+			}
+			if selectedActionCandidate.Action == "" { // first one
+				selectedActionCandidate = actionCandidate
+				continue
+			}
+			if len(actionCandidate.Path) > len(selectedActionCandidate.Path) { // longer path wins
+				selectedActionCandidate = actionCandidate
+				continue
+			}
+			if len(actionCandidate.Operation.Input.Required) > len(selectedActionCandidate.Operation.Input.Required) { // more requirements wins
+				selectedActionCandidate = actionCandidate
+				continue
+			}
 		}
-	}
 
-	// attempt to determine access key and/or session token from auth header
-	accessKey := ""
-	sessionToken := ""
-	authHeader := req.Header.Get("Authorization")
-	credOffset := strings.Index(authHeader, "Credential=")
-	if credOffset > 0 {
-		endOfKey := strings.Index(authHeader[credOffset:], "/")
-		if endOfKey > 0 {
-			accessKey = authHeader[credOffset+len("Credential=") : credOffset+endOfKey]
+		if selectedActionCandidate.Action != "" {
+			return selectedActionCandidate, true
 		}
+		if fallbackActionCandidate.Action != "" {
+			return fallbackActionCandidate, true
+		}
+		return ActionCandidate{}, false
 	}
 
-	sessionTokenHeader := req.Header.Get("X-Amz-Security-Token")
-	sessionTokenQuery := req.URL.Query().Get("X-Amz-Security-Token")
-	if sessionTokenHeader != "" {
-		sessionToken = sessionTokenHeader
-	} else if sessionTokenQuery != "" {
-		sessionToken = sessionTokenQuery
-	}
-
-	if selectedCandidate.Action != "" {
-		action = selectedCandidate.Action
-		params = selectedCandidate.Params
-		uriparams = selectedCandidate.URIParams
-		service = selectedCandidate.Service
+	if action == "" {
+		return ActionCandidate{}, false
 	}
 
-	callLog = append(callLog, Entry{
-		Region:              region,
-		Type:                "ProxyCall",
-		Service:             service,
-		Method:              action,
-		Parameters:          params,
-		URIParameters:       uriparams,
-		FinalHTTPStatusCode: respCode,
-		AccessKey:           accessKey,
-		SessionToken:        sessionToken,
-		Host:                host,
-	})
-
-	handleLoggedCall()
+	return ActionCandidate{
+		Action:          action,
+		Params:          params,
+		URIParams:       getHostPrefixParams(serviceDef.Operations[action], endpointUriPrefix),
+		Operation:       serviceDef.Operations[action],
+		Service:         service,
+		Metadata:        serviceDef.Metadata,
+		RequirementsMet: true,
+	}, true
 }
 
 var azurermregex = regexp.MustCompile(`^/subscriptions/.+/resourcegroups/.+/providers/Microsoft\.Resources/deployments/.+`)
 
-func handleAzureRequest(req *http.Request, body []byte, respCode int) {
+func (s *Session) handleAzureRequest(req *http.Request, body []byte, respCode int) {
 	host := req.Host
 
-	if host != "management.azure.com" { //} else if host == "management.core.windows.net" {
+	if host == "management.core.windows.net" { // classic service management API
 		return
 	}
 
-	azureCallLog = append(azureCallLog, AzureEntry{
+	entry := AzureEntry{
 		HTTPMethod: req.Method,
 		Path:       req.URL.Path,
 		Parameters: req.URL.Query(),
 		Body:       body,
-	})
+	}
+
+	s.mu.Lock()
+	s.azureCallLog = append(s.azureCallLog, entry)
+	s.mu.Unlock()
+	s.publishCall(CallEvent{Provider: "azure", Azure: &entry})
 
 	// Handle AzureRM deployments (inline only)
 	if req.Method == "PUT" { // TODO: other similar methods
@@ -860,19 +1206,21 @@ func handleAzureRequest(req *http.Request, body []byte, respCode int) {
 
 		ResourceLoop:
 			for _, azureResource := range template.Resources {
-				fmt.Println(azureResource.Name)
-				fmt.Println(azureResource.Type)
-
-				for pathName, pathObj := range azureIamMap["PUT"] {
+				for pathName, pathObj := range s.azureIamMap["PUT"] {
 					for permissionName := range pathObj {
 						if fmt.Sprintf("%s/write", azureResource.Type) == permissionName {
 							resourceJSON, _ := json.Marshal(azureResource)
 
-							azureCallLog = append(azureCallLog, AzureEntry{
+							resourceEntry := AzureEntry{
 								HTTPMethod: "PUT",
 								Path:       pathName,
 								Body:       resourceJSON,
-							})
+							}
+
+							s.mu.Lock()
+							s.azureCallLog = append(s.azureCallLog, resourceEntry)
+							s.mu.Unlock()
+							s.publishCall(CallEvent{Provider: "azure", Azure: &resourceEntry})
 
 							continue ResourceLoop
 						}
@@ -882,7 +1230,7 @@ func handleAzureRequest(req *http.Request, body []byte, respCode int) {
 		}
 	}
 
-	handleLoggedCall()
+	s.handleLoggedCall()
 }
 
 func generateMethodTemplate(path string) string {
@@ -928,7 +1276,7 @@ func gcpProcessResource(req *http.Request, gcpResource GCPResourceDefinition, ba
 	return ""
 }
 
-func handleGCPRequest(req *http.Request, body []byte, respCode int) {
+func (s *Session) handleGCPRequest(req *http.Request, body []byte, respCode int) {
 	host := req.Host
 	hostSplit := strings.Split(host, ".")
 	apiID := ""
@@ -938,7 +1286,7 @@ func handleGCPRequest(req *http.Request, body []byte, respCode int) {
 	}
 
 	for _, gcpService := range gcpServiceDefinitions {
-		if req.Host == gcpService.RootDomain {
+		if host == gcpService.RootDomain {
 			for _, gcpResource := range gcpService.Resources {
 				apiID = gcpProcessResource(req, gcpResource, gcpService.BasePath)
 				if apiID != "" {
@@ -955,13 +1303,36 @@ func handleGCPRequest(req *http.Request, body []byte, respCode int) {
 		return
 	}
 
-	gcpCallLog = append(gcpCallLog, apiID)
+	s.mu.Lock()
+	s.gcpCallLog = append(s.gcpCallLog, apiID)
+	s.mu.Unlock()
+	s.publishCall(CallEvent{Provider: "gcp", GCP: apiID})
+
+	s.handleLoggedCall()
+}
+
+// hasBlobPayload reports whether the operation input sends a raw (e.g. object) payload rather than structured members
+func hasBlobPayload(input ServiceStructure, shapes map[string]ServiceStructure) bool {
+	if input.Shape != "" {
+		input = shapes[input.Shape]
+	}
+	if input.Payload == "" {
+		return false
+	}
+
+	payloadMember, ok := input.Members[input.Payload]
+	if !ok {
+		return false
+	}
+	if payloadMember.Streaming {
+		return true
+	}
 
-	handleLoggedCall()
+	return shapes[payloadMember.Shape].Type == "blob"
 }
 
 func resolvePropertyName(obj ServiceStructure, searchProp string, path string, locationPath string, shapes map[string]ServiceStructure) (ret string) {
-	if searchProp[len(searchProp)-2:] == "[]" { // trim trailing []
+	if strings.HasSuffix(searchProp, "[]") { // trim trailing []
 		searchProp = searchProp[:len(searchProp)-2]
 	}
 
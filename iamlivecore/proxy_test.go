@@ -0,0 +1,37 @@
+package iamlivecore
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestGetServiceActionCandidateShortQueryKeys(t *testing.T) {
+	s, err := NewSession(Options{Mode: "proxy"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, serviceDefinition := range serviceDefinitions {
+		if serviceDefinition.Metadata.EndpointPrefix != "iam" || !serviceDefinition.IsLatest {
+			continue
+		}
+
+		for _, body := range []string{
+			"Action=GetRole&Version=2010-05-08&RoleName=r&a=1",
+			"Action=GetRole&Version=2010-05-08&RoleName=r&=x",
+			"Action=GetRole&Version=2010-05-08&RoleName=r&[]=x",
+		} {
+			req, _ := http.NewRequest("POST", "https://iam.amazonaws.com/", strings.NewReader(body))
+			req.RequestURI = "/"
+
+			candidate, ok := s.getServiceActionCandidate(serviceDefinition, req, []byte(body), nil, "")
+			if !ok || candidate.Action != "GetRole" {
+				t.Errorf("%s: got %q", body, candidate.Action)
+			}
+			if candidate.Params["RoleName"][0] != "r" {
+				t.Errorf("%s: params %v", body, candidate.Params)
+			}
+		}
+	}
+}
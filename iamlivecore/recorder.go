@@ -0,0 +1,96 @@
+package iamlivecore
+
+import (
+	"net/http"
+)
+
+// Recorder is an http.RoundTripper which records the requests made through it to a session, as the proxy does,
+// before passing them on. No listener, CA or sockets are involved, so the session needn't be started.
+type Recorder struct {
+	session   *Session
+	transport http.RoundTripper
+}
+
+// RoundTripper returns a Recorder passing requests on to transport, or http.DefaultTransport when nil. The session
+// should be in proxy mode for the policy to have resources.
+func (s *Session) RoundTripper(transport http.RoundTripper) *Recorder {
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+
+	return &Recorder{
+		session:   s,
+		transport: transport,
+	}
+}
+
+// RoundTrip records the request when a host rule intercepts its host, then sends it with the wrapped transport
+func (r *Recorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	s := r.session
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+
+	rule := s.matchHostRule(host, getRequestScheme(req))
+	if rule == nil || rule.Action != "mitm" || rule.Provider == "" || !s.isProviderEnabled(rule.Provider) {
+		return r.transport.RoundTrip(req)
+	}
+
+	if err := s.readServiceFiles(); err != nil {
+		return nil, err
+	}
+
+	req = req.Clone(req.Context()) // RoundTrip mustn't modify the caller's request
+	req.Host = host
+
+	body := s.readRequestBody(req)
+	if s.options.Debug {
+		dumpReq(req, body)
+	}
+
+	providerReq := getProviderRequest(req, rule)
+	providerURL := *req.URL
+	providerReq.URL = &providerURL
+	providerReq.RequestURI = req.URL.RequestURI() // as a server would see it
+
+	streamed := false
+	if rule.Provider == "aws" {
+		if body == nil && req.Body != nil && req.Body != http.NoBody && isAWSChunkedRequest(req) {
+			// record once the upload has streamed through so trailing checksums are known
+			streamed = true
+			req.Body = newAWSChunkedReader(req.Body, func(trailer http.Header) {
+				providerReq.Trailer = trailer
+				s.handleAWSRequest(providerReq, nil, 200)
+			})
+		}
+
+		if s.options.AWSRedirectHost != "" {
+			redirectURL := *req.URL
+			redirectURL.Host = s.options.AWSRedirectHost
+			req.URL = &redirectURL
+			req.Host = s.options.AWSRedirectHost
+		}
+	}
+
+	resp, err := r.transport.RoundTrip(req)
+
+	respCode := 0
+	if err == nil {
+		respCode = resp.StatusCode
+	}
+
+	switch rule.Provider {
+	case "aws":
+		if !streamed {
+			s.handleAWSRequest(providerReq, body, respCode)
+		}
+	case "azure":
+		s.handleAzureRequest(providerReq, body, respCode)
+	case "gcp":
+		s.handleGCPRequest(providerReq, body, respCode)
+	}
+
+	return resp, err
+}
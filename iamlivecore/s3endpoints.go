@@ -0,0 +1,152 @@
+package iamlivecore
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Doc: https://docs.aws.amazon.com/AmazonS3/latest/userguide/access-points-naming.html
+
+// s3Endpoint describes an S3 endpoint whose host carries more than a bucket name
+type s3Endpoint struct {
+	endpointPrefix    string // the endpoint prefix of the service definition the request is parsed with
+	endpointUriPrefix string // the host labels preceding the service, a stand-in bucket or a host prefix such as {AccountId}.
+	region            string // only set where the host does not end with the region
+	accessPointArn    string // the access point the request is made through, as passed to the SDK in place of the bucket
+	iamPrefix         string // the IAM service the actions are authorized against when it isn't s3
+	objectsUnderArn   bool   // whether objects are addressed beneath the access point ARN
+}
+
+var (
+	s3AccessPointHostRegex  = regexp.MustCompile(`^([^.]+)-(\d{12})\.s3-(accesspoint|object-lambda)(?:-fips)?(?:\.dualstack)?\.([^.]+)\.amazonaws\.com$`) // name-123456789012.s3-accesspoint.us-east-1.amazonaws.com
+	s3OutpostsHostRegex     = regexp.MustCompile(`^([^.]+)-(\d{12})\.(op-[0-9a-z]+)\.s3-outposts(?:-fips)?\.([^.]+)\.amazonaws\.com$`)                    // name-123456789012.op-01ac5d28a6a232904.s3-outposts.us-west-2.amazonaws.com
+	s3MultiRegionHostRegex  = regexp.MustCompile(`^(.+)\.accesspoint\.s3-global\.amazonaws\.com$`)                                                        // mfzwi23gnjvgw.mrap.accesspoint.s3-global.amazonaws.com
+	s3ControlHostRegex      = regexp.MustCompile(`^(\d{12})\.s3-control(?:-fips)?(?:\.dualstack)?\.([^.]+)\.amazonaws\.com$`)                             // 123456789012.s3-control.us-east-1.amazonaws.com
+	s3OutpostsControlRegex  = regexp.MustCompile(`^s3-outposts(?:-fips)?\.([^.]+)\.amazonaws\.com$`)                                                      // s3-outposts.us-west-2.amazonaws.com
+	s3ObjectLambdaHostRegex = regexp.MustCompile(`^([^.]+)\.s3-object-lambda(?:-fips)?\.([^.]+)\.amazonaws\.com$`)                                        // {RequestRoute}.s3-object-lambda.us-east-1.amazonaws.com
+)
+
+// parseS3Endpoint returns the S3 endpoint described by the host, or nil when the host isn't one of the special forms
+func parseS3Endpoint(host string) *s3Endpoint {
+	host = strings.TrimSuffix(strings.ToLower(host), ".cn")
+
+	if matches := s3AccessPointHostRegex.FindStringSubmatch(host); len(matches) == 5 {
+		if matches[3] == "object-lambda" {
+			return &s3Endpoint{
+				endpointPrefix:    "s3",
+				endpointUriPrefix: matches[1],
+				accessPointArn:    "arn:${Partition}:s3-object-lambda:" + matches[4] + ":" + matches[2] + ":accesspoint/" + matches[1],
+				iamPrefix:         "s3-object-lambda",
+			}
+		}
+
+		return &s3Endpoint{
+			endpointPrefix:    "s3",
+			endpointUriPrefix: matches[1],
+			accessPointArn:    "arn:${Partition}:s3:" + matches[4] + ":" + matches[2] + ":accesspoint/" + matches[1],
+			objectsUnderArn:   true,
+		}
+	}
+
+	if matches := s3OutpostsHostRegex.FindStringSubmatch(host); len(matches) == 5 {
+		return &s3Endpoint{
+			endpointPrefix:    "s3",
+			endpointUriPrefix: matches[1],
+			accessPointArn:    "arn:${Partition}:s3-outposts:" + matches[4] + ":" + matches[2] + ":outpost/" + matches[3] + "/accesspoint/" + matches[1],
+			iamPrefix:         "s3-outposts",
+			objectsUnderArn:   true,
+		}
+	}
+
+	if matches := s3MultiRegionHostRegex.FindStringSubmatch(host); len(matches) == 2 {
+		return &s3Endpoint{
+			endpointPrefix:    "s3",
+			endpointUriPrefix: matches[1],
+			region:            "*", // signed with SigV4A for all regions
+			accessPointArn:    "arn:${Partition}:s3::${Account}:accesspoint/" + matches[1],
+			objectsUnderArn:   true,
+		}
+	}
+
+	if matches := s3ControlHostRegex.FindStringSubmatch(host); len(matches) == 3 {
+		return &s3Endpoint{
+			endpointPrefix:    "s3-control",
+			endpointUriPrefix: matches[1],
+		}
+	}
+
+	if s3OutpostsControlRegex.MatchString(host) {
+		return &s3Endpoint{
+			endpointPrefix: "s3-control",
+			iamPrefix:      "s3-outposts",
+		}
+	}
+
+	if matches := s3ObjectLambdaHostRegex.FindStringSubmatch(host); len(matches) == 3 { // WriteGetObjectResponse
+		return &s3Endpoint{
+			endpointPrefix: "s3",
+			iamPrefix:      "s3-object-lambda", // the route isn't a bucket, it's also sent as x-amz-request-route
+		}
+	}
+
+	return nil
+}
+
+// getHostPrefixParams extracts the members an operation binds into the host, e.g. {AccountId}. for S3 Control
+func getHostPrefixParams(operation ServiceOperation, endpointUriPrefix string) map[string]string {
+	params := map[string]string{}
+
+	if operation.Endpoint.HostPrefix == "" || endpointUriPrefix == "" {
+		return params
+	}
+
+	templateMatches := regexp.MustCompile(`{([^}]+?)}`).FindAllStringSubmatch(operation.Endpoint.HostPrefix, -1)
+	regexStr := regexp.MustCompile(`\\{([^}]+?)\\}`).ReplaceAllString(regexp.QuoteMeta(operation.Endpoint.HostPrefix), `([^.]+)`)
+	hostMatches := regexp.MustCompile("^" + regexStr + "$").FindStringSubmatch(endpointUriPrefix + ".")
+
+	if len(hostMatches) == len(templateMatches)+1 {
+		for i, templateMatch := range templateMatches {
+			params[templateMatch[1]] = hostMatches[i+1]
+		}
+	}
+
+	return params
+}
+
+// applyS3Endpoint rewrites the action and resources of a call made through an access point, Outposts or Object
+// Lambda endpoint so that they name the access point rather than the bucket
+func (s *Session) applyS3Endpoint(call Entry, action string, resources []string) (string, []string) {
+	endpoint := parseS3Endpoint(call.Host)
+	if endpoint == nil {
+		return action, resources
+	}
+
+	if endpoint.iamPrefix != "" && strings.HasPrefix(action, "s3:") {
+		action = endpoint.iamPrefix + action[len("s3"):]
+	}
+
+	if endpoint.accessPointArn == "" {
+		return action, resources
+	}
+
+	_, accessPointArns := s.subARNParameters(endpoint.accessPointArn, call, false)
+	accessPointArn := accessPointArns[0]
+	bucketParamArn := strings.ReplaceAll(endpoint.accessPointArn, "${Partition}", getPartitionFromRegion(call.Region)) // as set by the proxy
+
+	// the bucket is either the stand-in name or, through the Bucket parameter, the access point ARN itself
+	bucketArnRegex := regexp.MustCompile(`^arn:(?:\$\{[^}]+\}|[^:]+):s3:::(?:` + regexp.QuoteMeta(endpoint.endpointUriPrefix) + `|` + regexp.QuoteMeta(accessPointArn) + `|` + regexp.QuoteMeta(bucketParamArn) + `)(/.*)?$`)
+
+	newResources := newUniqueStringList()
+	for _, resource := range resources {
+		matches := bucketArnRegex.FindStringSubmatch(resource)
+		if len(matches) != 2 {
+			newResources.add(resource)
+		} else if matches[1] == "" || !endpoint.objectsUnderArn {
+			newResources.add(accessPointArn)
+		} else {
+			newResources.add(accessPointArn + "/object" + matches[1])
+		}
+	}
+
+	return action, newResources.list
+}
@@ -1,12 +1,15 @@
 package iamlivecore
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
 	"os"
 	"os/exec"
+	"os/signal"
 	"runtime/pprof"
+	"syscall"
 
 	"github.com/mitchellh/go-homedir"
 	"gopkg.in/ini.v1"
@@ -33,6 +36,28 @@ var forceWildcardResourceFlag *bool
 var cpuProfileFlag = flag.String("cpu-profile", "", "write a CPU profile to this file (for performance testing purposes)")
 var csmPortFlag *int
 var awsRedirectHostFlag *string
+var upstreamProxyFlag *string
+var noProxyFlag *string
+var hostRulesFlag *string
+var maxBodySizeFlag *int
+var implicitRulesFlag *string
+var overlayAwsMapFlag *string
+var overlayAzureMapFlag *string
+var overlayGcpMapFlag *string
+var showMappingFlag *string
+var validateMapFlag *string
+var coverageFlag *bool
+var coverageFileFlag *string
+var callStatsFlag *bool
+var callStatsFileFlag *string
+var csmListenFlag *string
+var csmForwardFlag *string
+var csmBufferFileFlag *string
+var csmReplayFlag *string
+var policyVariablesFlag *bool
+var arnPlaceholdersFlag *bool
+var arnRegionFlag *string
+var arnAccountFlag *string
 
 func parseConfig() {
 	provider := "aws"
@@ -54,6 +79,25 @@ func parseConfig() {
 	forceWildcardResource := false
 	csmPort := 31000
 	awsRedirectHost := ""
+	upstreamProxy := ""
+	noProxy := ""
+	hostRules := ""
+	implicitRules := ""
+	overlayAwsMap := ""
+	overlayAzureMap := ""
+	overlayGcpMap := ""
+	maxBodySize := 10485760
+	coverage := false
+	coverageFile := ""
+	callStats := false
+	callStatsFile := ""
+	csmListen := ""
+	csmForward := ""
+	csmBufferFile := ""
+	policyVariables := false
+	arnPlaceholders := false
+	arnRegion := ""
+	arnAccount := ""
 
 	cfgfile, err := homedir.Expand("~/.iamlive/config")
 	if err == nil {
@@ -113,11 +157,68 @@ func parseConfig() {
 			if cfg.Section("").HasKey("aws-redirect-host") {
 				awsRedirectHost = cfg.Section("").Key("aws-redirect-host").String()
 			}
+			if cfg.Section("").HasKey("upstream-proxy") {
+				upstreamProxy = cfg.Section("").Key("upstream-proxy").String()
+			}
+			if cfg.Section("").HasKey("no-proxy") {
+				noProxy = cfg.Section("").Key("no-proxy").String()
+			}
+			if cfg.Section("").HasKey("host-rules") {
+				hostRules = cfg.Section("").Key("host-rules").String()
+			}
+			if cfg.Section("").HasKey("implicit-rules") {
+				implicitRules = cfg.Section("").Key("implicit-rules").String()
+			}
+			if cfg.Section("").HasKey("overlay-aws-map") {
+				overlayAwsMap = cfg.Section("").Key("overlay-aws-map").String()
+			}
+			if cfg.Section("").HasKey("overlay-azure-map") {
+				overlayAzureMap = cfg.Section("").Key("overlay-azure-map").String()
+			}
+			if cfg.Section("").HasKey("overlay-gcp-map") {
+				overlayGcpMap = cfg.Section("").Key("overlay-gcp-map").String()
+			}
+			if cfg.Section("").HasKey("max-body-size") {
+				maxBodySize, _ = cfg.Section("").Key("max-body-size").Int()
+			}
+			if cfg.Section("").HasKey("coverage") {
+				coverage, _ = cfg.Section("").Key("coverage").Bool()
+			}
+			if cfg.Section("").HasKey("coverage-file") {
+				coverageFile = cfg.Section("").Key("coverage-file").String()
+			}
+			if cfg.Section("").HasKey("call-stats") {
+				callStats, _ = cfg.Section("").Key("call-stats").Bool()
+			}
+			if cfg.Section("").HasKey("call-stats-file") {
+				callStatsFile = cfg.Section("").Key("call-stats-file").String()
+			}
+			if cfg.Section("").HasKey("csm-listen") {
+				csmListen = cfg.Section("").Key("csm-listen").String()
+			}
+			if cfg.Section("").HasKey("csm-forward") {
+				csmForward = cfg.Section("").Key("csm-forward").String()
+			}
+			if cfg.Section("").HasKey("csm-buffer-file") {
+				csmBufferFile = cfg.Section("").Key("csm-buffer-file").String()
+			}
+			if cfg.Section("").HasKey("policy-variables") {
+				policyVariables, _ = cfg.Section("").Key("policy-variables").Bool()
+			}
+			if cfg.Section("").HasKey("arn-placeholders") {
+				arnPlaceholders, _ = cfg.Section("").Key("arn-placeholders").Bool()
+			}
+			if cfg.Section("").HasKey("arn-region") {
+				arnRegion = cfg.Section("").Key("arn-region").String()
+			}
+			if cfg.Section("").HasKey("arn-account") {
+				arnAccount = cfg.Section("").Key("arn-account").String()
+			}
 
 		}
 	}
 
-	providerFlag = flag.String("provider", provider, "the cloud service provider to intercept calls for")
+	providerFlag = flag.String("provider", provider, "the cloud service provider(s) to intercept calls for, comma-separated (aws,azure,gcp) or all")
 	setiniFlag = flag.Bool("set-ini", setIni, "when set, the .aws/config file will be updated to use the CSM monitoring or CA bundle and removed when exiting")
 	profileFlag = flag.String("profile", profile, "use the specified profile when combined with --set-ini")
 	failsonlyFlag = flag.Bool("fails-only", failsOnly, "when set, only failed AWS calls will be added to the policy, csm mode only")
@@ -125,17 +226,126 @@ func parseConfig() {
 	refreshRateFlag = flag.Int("refresh-rate", refreshRate, "instead of flushing to console every API call, do it this number of seconds")
 	sortAlphabeticalFlag = flag.Bool("sort-alphabetical", sortAlphabetical, "sort actions alphabetically")
 	hostFlag = flag.String("host", host, "host to listen on for CSM")
-	modeFlag = flag.String("mode", mode, "the listening mode (csm,proxy)")
+	modeFlag = flag.String("mode", mode, "the listening mode (csm,proxy,hybrid)")
 	bindAddrFlag = flag.String("bind-addr", bindAddr, "the bind address for proxy mode")
 	caBundleFlag = flag.String("ca-bundle", caBundle, "the CA certificate bundle (PEM) to use for proxy mode")
 	caKeyFlag = flag.String("ca-key", caKey, "the CA certificate key to use for proxy mode")
 	accountIDFlag = flag.String("account-id", accountID, "the AWS account ID to use in policy outputs within proxy mode")
 	backgroundFlag = flag.Bool("background", background, "when set, the process will return the current PID and run in the background without output")
 	overrideAwsMapFlag = flag.String("override-aws-map", overrideAwsMap, "overrides the embedded AWS mapping JSON file with the filepath provided")
-	debugFlag = flag.Bool("debug", debug, "dumps associated HTTP requests when set in proxy mode")
+	debugFlag = flag.Bool("debug", debug, "dumps associated HTTP requests when set in proxy mode, and rejected CSM entries in csm mode")
 	forceWildcardResourceFlag = flag.Bool("force-wildcard-resource", forceWildcardResource, "when set, the Resource will always be a wildcard")
 	csmPortFlag = flag.Int("csm-port", csmPort, "port to listen on for CSM")
 	awsRedirectHostFlag = flag.String("aws-redirect-host", awsRedirectHost, "redirect all AWS API calls to this endpoint")
+	upstreamProxyFlag = flag.String("upstream-proxy", upstreamProxy, "the upstream HTTP(S) proxy to chain requests through in proxy mode, defaults to the HTTPS_PROXY environment variable")
+	noProxyFlag = flag.String("no-proxy", noProxy, "comma-separated hosts, domains and CIDRs to connect to directly rather than via the upstream proxy, defaults to the NO_PROXY environment variable")
+	hostRulesFlag = flag.String("host-rules", hostRules, "a JSON file of rules deciding which hosts are intercepted in proxy mode and which provider handles them")
+	implicitRulesFlag = flag.String("implicit-rules", implicitRules, "a JSON file of rules granting further permissions when calls carry certain parameters, such as iam:PassRole for roles passed to a service")
+	overlayAwsMapFlag = flag.String("overlay-aws-map", overlayAwsMap, "comma-separated partial AWS mapping JSON files merged over the embedded mapping, in order")
+	overlayAzureMapFlag = flag.String("overlay-azure-map", overlayAzureMap, "comma-separated partial Azure mapping JSON files merged over the embedded mapping, in order")
+	overlayGcpMapFlag = flag.String("overlay-gcp-map", overlayGcpMap, "comma-separated partial GCP mapping JSON files merged over the embedded mapping, in order")
+	showMappingFlag = flag.String("show-mapping", "", "print the effective mapping for an AWS SDK method (S3.GetObject), Azure request (GET /path) or GCP method (compute.instances.get) and exit")
+	validateMapFlag = flag.String("validate-map", "", "check an AWS mapping or overlay file against the IAM and API definitions, print any issues and exit")
+	coverageFlag = flag.Bool("coverage", coverage, "when set, lists the unrecognized calls, guessed actions and wildcard resources of the AWS policy beneath it")
+	coverageFileFlag = flag.String("coverage-file", coverageFile, "specify a file that the coverage report of the AWS policy will be written to on SIGHUP or exit")
+	callStatsFlag = flag.Bool("call-stats", callStats, "when set, lists the denied calls, retries and latency of each action by SDK client beneath the policy, csm and hybrid modes only")
+	callStatsFileFlag = flag.String("call-stats-file", callStatsFile, "specify a file that the call stats, including the policy of each SDK client, will be written to on SIGHUP or exit, csm and hybrid modes only")
+	csmListenFlag = flag.String("csm-listen", csmListen, "comma-separated addresses to listen on for CSM in place of --host and --csm-port, as host:port, [ipv6]:port or unix:///path/to/socket")
+	csmForwardFlag = flag.String("csm-forward", csmForward, "comma-separated host:port CSM listeners that every datagram received is sent on to unchanged, csm and hybrid modes only")
+	csmBufferFileFlag = flag.String("csm-buffer-file", csmBufferFile, "a file every CSM datagram received is appended to, for later use with --csm-replay, csm and hybrid modes only")
+	csmReplayFlag = flag.String("csm-replay", "", "record the CSM datagrams of a file written with --csm-buffer-file before listening")
+	policyVariablesFlag = flag.Bool("policy-variables", policyVariables, "when set, IAM policy variables such as ${aws:username} in mapping templates are kept in resources rather than becoming wildcards")
+	arnPlaceholdersFlag = flag.Bool("arn-placeholders", arnPlaceholders, "when set, resources use the ${AWS::Partition}, ${AWS::Region} and ${AWS::AccountId} placeholders in place of the partition, region and account of the call")
+	arnRegionFlag = flag.String("arn-region", arnRegion, "the region to use in resources in place of that of the call, such as *")
+	arnAccountFlag = flag.String("arn-account", arnAccount, "the account to use in resources in place of that of the call, such as *")
+	maxBodySizeFlag = flag.Int("max-body-size", maxBodySize, "the largest request body, in bytes, that will be buffered for parsing in proxy mode, larger bodies stream through unparsed")
+}
+
+var allProviders = []string{"aws", "azure", "gcp"}
+
+// getFlagOptions returns the session options set by the CLI args
+func getFlagOptions() Options {
+	return Options{
+		Provider:              *providerFlag,
+		Mode:                  *modeFlag,
+		SetINI:                *setiniFlag,
+		Profile:               *profileFlag,
+		FailsOnly:             *failsonlyFlag,
+		OutputFile:            *outputFileFlag,
+		RefreshRate:           *refreshRateFlag,
+		SortAlphabetical:      *sortAlphabeticalFlag,
+		Host:                  *hostFlag,
+		CSMPort:               *csmPortFlag,
+		BindAddr:              *bindAddrFlag,
+		CABundle:              *caBundleFlag,
+		CAKey:                 *caKeyFlag,
+		AccountID:             *accountIDFlag,
+		Debug:                 *debugFlag,
+		ForceWildcardResource: *forceWildcardResourceFlag,
+		AWSRedirectHost:       *awsRedirectHostFlag,
+		UpstreamProxy:         *upstreamProxyFlag,
+		NoProxy:               *noProxyFlag,
+		HostRules:             *hostRulesFlag,
+		ImplicitRules:         *implicitRulesFlag,
+		OverrideAWSMap:        *overrideAwsMapFlag,
+		OverlayAWSMap:         *overlayAwsMapFlag,
+		OverlayAzureMap:       *overlayAzureMapFlag,
+		OverlayGCPMap:         *overlayGcpMapFlag,
+		MaxBodySize:           *maxBodySizeFlag,
+		Coverage:              *coverageFlag,
+		CoverageFile:          *coverageFileFlag,
+		CallStats:             *callStatsFlag,
+		CallStatsFile:         *callStatsFileFlag,
+		CSMListen:             *csmListenFlag,
+		CSMForward:            *csmForwardFlag,
+		CSMBufferFile:         *csmBufferFileFlag,
+		PolicyVariables:       *policyVariablesFlag,
+		ARNPlaceholders:       *arnPlaceholdersFlag,
+		ARNRegion:             *arnRegionFlag,
+		ARNAccount:            *arnAccountFlag,
+		Terminal:              !*backgroundFlag,
+	}
+}
+
+// runSession runs the session as the default session until the process is signalled to exit, flushing the output
+// files on SIGHUP
+func runSession(s *Session) {
+	defaultSession = s
+
+	if err := s.Start(context.Background()); err != nil {
+		log.Fatal(err)
+	}
+
+	// listen for exit, cleanup and flush
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc,
+		syscall.SIGHUP,
+		syscall.SIGINT,
+		syscall.SIGTERM,
+		syscall.SIGQUIT)
+	go func() {
+		for sig := range sigc {
+			if sig == syscall.SIGHUP {
+				if err := s.Flush(); err != nil {
+					log.Fatal(err)
+				}
+				continue
+			}
+
+			err := s.Stop()
+			pprof.StopCPUProfile()
+			if err != nil {
+				log.Fatal(err)
+			}
+			os.Exit(0)
+		}
+	}()
+
+	if err := s.Wait(); err != nil {
+		s.Stop()
+		log.Fatal(err)
+	}
+	select {} // exited by the signal handler
 }
 
 func Run() {
@@ -143,8 +353,30 @@ func Run() {
 
 	flag.Parse()
 
-	if *providerFlag != "aws" {
-		*modeFlag = "proxy"
+	options := getFlagOptions()
+	if options.Provider != "aws" && options.Mode != "hybrid" {
+		options.Mode = "proxy"
+	}
+
+	s, err := NewSession(options)
+	if err != nil {
+		fmt.Println("ERROR: " + err.Error())
+		return
+	}
+
+	if *showMappingFlag != "" {
+		s.printEffectiveMapping(*showMappingFlag)
+		return
+	}
+
+	if *validateMapFlag != "" {
+		if err := s.readServiceFiles(); err != nil {
+			log.Fatal(err)
+		}
+		if !s.printMapValidation(*validateMapFlag) {
+			os.Exit(1)
+		}
+		return
 	}
 
 	if *backgroundFlag {
@@ -170,44 +402,16 @@ func Run() {
 		defer pprof.StopCPUProfile()
 	}
 
-	if *refreshRateFlag != 0 {
-		setTerminalRefresh()
+	if *csmReplayFlag != "" {
+		if err := s.ReplayCSMFile(*csmReplayFlag); err != nil {
+			log.Fatal(err)
+		}
 	}
 
-	setINIConfigAndFileFlush()
-
-	loadMaps()
-
-	if *modeFlag == "csm" && *providerFlag == "aws" {
-		listenForEvents()
-		handleLoggedCall()
-	} else if *modeFlag == "proxy" {
-		readServiceFiles()
-		createProxy(*bindAddrFlag, *awsRedirectHostFlag)
-	} else {
-		fmt.Println("ERROR: unknown mode")
-	}
+	runSession(s)
 }
 
 func RunWithArgs(provider string, setIni bool, profile string, failsOnly bool, outputFile string, refreshRate int, sortAlphabetical bool, host, mode, bindAddr, caBundle, caKey, accountID string, background, debug, forceWildcardResource bool, awsRedirectHost string) {
-	providerFlag = &provider
-	setiniFlag = &setIni
-	profileFlag = &profile
-	failsonlyFlag = &failsOnly
-	outputFileFlag = &outputFile
-	refreshRateFlag = &refreshRate
-	sortAlphabeticalFlag = &sortAlphabetical
-	hostFlag = &host
-	modeFlag = &mode
-	bindAddrFlag = &bindAddr
-	caBundleFlag = &caBundle
-	caKeyFlag = &caKey
-	accountIDFlag = &accountID
-	backgroundFlag = &background
-	debugFlag = &debug
-	forceWildcardResourceFlag = &forceWildcardResource
-	awsRedirectHostFlag = &awsRedirectHost
-
 	if *cpuProfileFlag != "" {
 		f, err := os.Create(*cpuProfileFlag)
 		if err != nil {
@@ -217,21 +421,31 @@ func RunWithArgs(provider string, setIni bool, profile string, failsOnly bool, o
 		defer pprof.StopCPUProfile()
 	}
 
-	if *refreshRateFlag != 0 {
-		setTerminalRefresh()
+	options := Options{
+		Provider:              provider,
+		Mode:                  mode,
+		SetINI:                setIni,
+		Profile:               profile,
+		FailsOnly:             failsOnly,
+		OutputFile:            outputFile,
+		RefreshRate:           refreshRate,
+		SortAlphabetical:      sortAlphabetical,
+		Host:                  host,
+		BindAddr:              bindAddr,
+		CABundle:              caBundle,
+		CAKey:                 caKey,
+		AccountID:             accountID,
+		Debug:                 debug,
+		ForceWildcardResource: forceWildcardResource,
+		AWSRedirectHost:       awsRedirectHost,
+		Terminal:              !background,
 	}
 
-	setINIConfigAndFileFlush()
-
-	loadMaps()
-
-	if *modeFlag == "csm" && *providerFlag == "aws" {
-		listenForEvents()
-		handleLoggedCall()
-	} else if *modeFlag == "proxy" {
-		readServiceFiles()
-		createProxy(*bindAddrFlag, *awsRedirectHostFlag)
-	} else {
-		fmt.Println("ERROR: unknown mode")
+	s, err := NewSession(options)
+	if err != nil {
+		fmt.Println("ERROR: " + err.Error())
+		return
 	}
+
+	runSession(s)
 }
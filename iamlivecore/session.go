@@ -0,0 +1,527 @@
+package iamlivecore
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mitchellh/go-homedir"
+)
+
+// Options configures a Session, each field matching the CLI argument of the same name. Zero values take the CLI
+// defaults.
+type Options struct {
+	Provider              string // aws, azure or gcp, comma-separated, or all
+	Mode                  string // csm, proxy or hybrid, proxy when a provider other than aws is selected
+	SetINI                bool
+	Profile               string
+	FailsOnly             bool
+	OutputFile            string // written on Flush and Stop
+	RefreshRate           int
+	SortAlphabetical      bool
+	Host                  string
+	CSMPort               int
+	CSMListen             string // comma-separated addresses to listen on for CSM in place of Host and CSMPort
+	BindAddr              string
+	CABundle              string
+	CAKey                 string
+	AccountID             string
+	Debug                 bool
+	ForceWildcardResource bool
+	AWSRedirectHost       string
+	UpstreamProxy         string
+	NoProxy               string
+	HostRules             string
+	ImplicitRules         string
+	OverrideAWSMap        string
+	OverlayAWSMap         string
+	OverlayAzureMap       string
+	OverlayGCPMap         string
+	MaxBodySize           int
+	Coverage              bool
+	CoverageFile          string // written on Flush and Stop
+	CallStats             bool
+	CallStatsFile         string // written on Flush and Stop
+	CSMForward            string // host:port listeners, comma-separated, the CSM datagrams received are sent on to
+	CSMBufferFile         string // appended to with the CSM datagrams received, for ReplayCSMFile
+	PolicyVariables       bool
+	ARNPlaceholders       bool
+	ARNRegion             string
+	ARNAccount            string
+	Terminal              bool // writes the policy to the terminal as calls are made
+}
+
+func (options *Options) setDefaults() {
+	if options.Provider == "" {
+		options.Provider = "aws"
+	}
+	if options.Mode == "" {
+		options.Mode = "csm"
+		if options.Provider != "aws" {
+			options.Mode = "proxy"
+		}
+	}
+	if options.Profile == "" {
+		options.Profile = "default"
+	}
+	if options.Host == "" {
+		options.Host = "127.0.0.1"
+	}
+	if options.CSMPort == 0 {
+		options.CSMPort = 31000
+	}
+	if options.BindAddr == "" {
+		options.BindAddr = "127.0.0.1:10080"
+	}
+	if options.CABundle == "" {
+		options.CABundle = "~/.iamlive/ca.pem"
+	}
+	if options.CAKey == "" {
+		options.CAKey = "~/.iamlive/ca.key"
+	}
+	if options.MaxBodySize == 0 {
+		options.MaxBodySize = 10485760
+	}
+}
+
+// Session captures the calls made through a CSM listener or proxy and the policies they need. Sessions are
+// independent, so several can run in one process on different addresses.
+type Session struct {
+	options Options
+
+	mu                  sync.Mutex
+	callLog             []Entry
+	azureCallLog        []AzureEntry
+	gcpCallLog          []string
+	unrecognizedCallLog []unrecognizedEntry
+	attemptLog          []Entry
+	csmStats            CSMStats
+
+	iamMap                  iamMapBase
+	azureIamMap             azureIamMapBase
+	gcpIamMap               gcpIamMapBase
+	hostRules               []HostRule
+	implicitPermissionRules []ImplicitPermissionRule
+	actionExclusionRules    []ActionExclusionRule
+	hybridServiceNames      map[string]string // see getHybridServiceNames
+	hybridServiceNamesOnce  sync.Once
+
+	subscribers eventSubscribers
+
+	started        bool
+	closing        bool
+	stopOnce       sync.Once
+	stopped        chan struct{}
+	err            error // the error the listener stopped with
+	csmConns       []net.PacketConn
+	csmSocketPaths []string // removed on Stop
+	csmRelay       csmRelay
+	server         *http.Server
+}
+
+// Policy holds the policy of each provider enabled for a session
+type Policy struct {
+	AWS   *IAMPolicy      `json:"aws,omitempty"`
+	Azure *AzureIAMPolicy `json:"azure,omitempty"`
+	GCP   []string        `json:"gcp,omitempty"`
+}
+
+// NewSession loads the mappings and definitions for a session, which starts capturing calls with Start
+func NewSession(options Options) (*Session, error) {
+	options.setDefaults()
+
+	s := &Session{
+		options: options,
+		stopped: make(chan struct{}),
+	}
+
+	if err := validateProviders(options.Provider); err != nil {
+		return nil, err
+	}
+	if options.Mode != "csm" && options.Mode != "proxy" && options.Mode != "hybrid" {
+		return nil, fmt.Errorf("unknown mode %q", options.Mode)
+	}
+	if options.Mode == "csm" && options.Provider != "aws" {
+		return nil, fmt.Errorf("csm mode is only available for the aws provider")
+	}
+	if options.Mode == "hybrid" && !s.isProviderEnabled("aws") {
+		return nil, fmt.Errorf("hybrid mode needs the aws provider")
+	}
+
+	if err := s.loadMaps(); err != nil {
+		return nil, err
+	}
+
+	if options.Mode != "csm" {
+		if err := s.readServiceFiles(); err != nil {
+			return nil, err
+		}
+	}
+	if err := s.loadHostRules(); err != nil { // also used by RoundTripper
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Start listens for CSM events, proxied requests or both in hybrid mode, returning once listening. The session is
+// stopped when the context is done.
+func (s *Session) Start(ctx context.Context) error {
+	s.mu.Lock()
+	if s.started || s.closing {
+		s.mu.Unlock()
+		return fmt.Errorf("session already started")
+	}
+	s.started = true
+	s.mu.Unlock()
+
+	if s.options.Mode != "proxy" {
+		if err := s.startCSMListeners(); err != nil {
+			s.abortStart(err)
+			return err
+		}
+	}
+	if s.options.Mode != "csm" {
+		if err := s.startProxy(); err != nil {
+			s.abortStart(err)
+			return err
+		}
+	}
+
+	if s.options.SetINI {
+		if err := s.setINIConfig(false); err != nil {
+			s.abortStart(err)
+			return err
+		}
+	}
+
+	if s.options.Terminal && s.options.RefreshRate > 0 {
+		go s.refreshTerminal()
+	}
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.Stop()
+		case <-s.stopped:
+		}
+	}()
+
+	return nil
+}
+
+func (s *Session) startProxy() error {
+	proxy, err := s.createProxy()
+	if err != nil {
+		return err
+	}
+	listener, err := net.Listen("tcp", s.options.BindAddr)
+	if err != nil {
+		return err
+	}
+	s.server = &http.Server{Handler: proxy}
+
+	go func() {
+		s.listenerStopped(s.server.Serve(listener))
+	}()
+
+	return nil
+}
+
+// abortStart closes what Start has listened on so far, stopping the session with err
+func (s *Session) abortStart(err error) {
+	s.mu.Lock()
+	s.closing = true
+	s.mu.Unlock()
+	s.closeListener()
+	s.finish(err)
+}
+
+// listenerStopped records why the listener stopped, unless it was closed by Stop
+func (s *Session) listenerStopped(err error) {
+	s.mu.Lock()
+	closing := s.closing
+	s.mu.Unlock()
+
+	if !closing {
+		s.finish(err)
+	}
+}
+
+func (s *Session) finish(err error) {
+	s.stopOnce.Do(func() {
+		s.err = err
+		close(s.stopped)
+	})
+}
+
+// Stop closes the listener, reverts the AWS config file when SetINI is set and writes the output files
+func (s *Session) Stop() error {
+	s.mu.Lock()
+	if s.closing { // already stopping
+		s.mu.Unlock()
+		<-s.stopped
+		return nil
+	}
+	s.closing = true
+	started := s.started
+	s.mu.Unlock()
+
+	defer s.finish(nil)
+
+	var errs []string
+	if err := s.closeListener(); err != nil {
+		errs = append(errs, err.Error())
+	}
+
+	if s.options.SetINI && started {
+		if err := s.setINIConfig(true); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	if err := s.Flush(); err != nil {
+		errs = append(errs, err.Error())
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func (s *Session) closeListener() error {
+	if s.csmConns != nil {
+		s.closeCSMListeners()
+		s.closeCSMRelay()
+	}
+	if s.server != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		return s.server.Shutdown(ctx)
+	}
+
+	return nil
+}
+
+// Wait blocks until the session is stopped, returning the error the listener failed with if it wasn't stopped by Stop
+func (s *Session) Wait() error {
+	<-s.stopped
+	return s.err
+}
+
+// Flush writes the policy, coverage report and call stats to the output files set in the options
+func (s *Session) Flush() error {
+	if s.options.OutputFile != "" {
+		err := ioutil.WriteFile(s.options.OutputFile, s.PolicyDocument(), 0644)
+		if err != nil {
+			return fmt.Errorf("error writing policy to %s: %v", s.options.OutputFile, err)
+		}
+	}
+	if s.options.CoverageFile != "" {
+		err := ioutil.WriteFile(s.options.CoverageFile, s.CoverageReportDocument(), 0644)
+		if err != nil {
+			return fmt.Errorf("error writing coverage report to %s: %v", s.options.CoverageFile, err)
+		}
+	}
+	if s.options.CallStatsFile != "" {
+		err := ioutil.WriteFile(s.options.CallStatsFile, s.CallStatsDocument(), 0644)
+		if err != nil {
+			return fmt.Errorf("error writing call stats to %s: %v", s.options.CallStatsFile, err)
+		}
+	}
+
+	return nil
+}
+
+// Reset forgets the calls captured so far
+func (s *Session) Reset() {
+	s.mu.Lock()
+	s.callLog = []Entry{}
+	s.azureCallLog = []AzureEntry{}
+	s.gcpCallLog = []string{}
+	s.unrecognizedCallLog = []unrecognizedEntry{}
+	s.attemptLog = []Entry{}
+	s.mu.Unlock()
+
+	s.resetEvents()
+}
+
+// Policy returns the policies of the enabled providers for the calls captured so far
+func (s *Session) Policy() Policy {
+	policy := Policy{}
+
+	if s.isProviderEnabled("aws") {
+		awsPolicy := s.getAWSPolicy()
+		policy.AWS = &awsPolicy
+	}
+	if s.isProviderEnabled("azure") {
+		azurePolicy := s.getAzurePolicy()
+		policy.Azure = &azurePolicy
+	}
+	if s.isProviderEnabled("gcp") {
+		policy.GCP = s.getGCPPermissions()
+	}
+
+	return policy
+}
+
+// PolicyDocument returns the policy for the enabled provider, or the policies of all enabled providers keyed by
+// provider, as JSON
+func (s *Session) PolicyDocument() []byte {
+	providers := s.getEnabledProviders()
+	if len(providers) == 1 {
+		return s.ProviderPolicyDocument(providers[0])
+	}
+
+	policies := make(map[string]json.RawMessage)
+	for _, provider := range providers {
+		policies[provider] = s.ProviderPolicyDocument(provider)
+	}
+
+	doc, err := json.MarshalIndent(policies, "", "    ")
+	if err != nil {
+		panic(err)
+	}
+	return doc
+}
+
+// ProviderPolicyDocument returns the policy for a single provider as JSON
+func (s *Session) ProviderPolicyDocument(provider string) []byte {
+	var policy interface{}
+
+	switch provider {
+	case "aws":
+		policy = s.getAWSPolicy()
+	case "azure":
+		policy = s.getAzurePolicy()
+	case "gcp":
+		policy = s.getGCPPermissions()
+	default:
+		return []byte("ERROR")
+	}
+
+	doc, err := json.MarshalIndent(policy, "", "    ")
+	if err != nil {
+		panic(err)
+	}
+	return doc
+}
+
+// validateProviders checks each provider in a comma-separated list is known
+func validateProviders(providers string) error {
+	selected := 0
+ProviderLoop:
+	for _, provider := range strings.Split(providers, ",") {
+		provider = strings.ToLower(strings.TrimSpace(provider))
+		if provider == "" {
+			continue
+		}
+		selected++
+		if provider == "all" {
+			continue
+		}
+		for _, knownProvider := range allProviders {
+			if provider == knownProvider {
+				continue ProviderLoop
+			}
+		}
+		return fmt.Errorf("unknown provider %q", provider)
+	}
+
+	if selected == 0 {
+		return fmt.Errorf("unknown provider %q", providers)
+	}
+	return nil
+}
+
+// getEnabledProviders returns the providers selected by the Provider option, in a stable order
+func (s *Session) getEnabledProviders() []string {
+	selected := map[string]bool{}
+	for _, provider := range strings.Split(s.options.Provider, ",") {
+		provider = strings.ToLower(strings.TrimSpace(provider))
+		if provider == "all" {
+			return allProviders
+		}
+		selected[provider] = true
+	}
+
+	providers := []string{}
+	for _, provider := range allProviders {
+		if selected[provider] {
+			providers = append(providers, provider)
+		}
+	}
+
+	return providers
+}
+
+func (s *Session) isProviderEnabled(provider string) bool {
+	for _, enabledProvider := range s.getEnabledProviders() {
+		if enabledProvider == provider {
+			return true
+		}
+	}
+
+	return false
+}
+
+// setINIConfig points the AWS config file profile at the CSM listener, CA bundle or both, or removes this when unset
+func (s *Session) setINIConfig(unset bool) error {
+	cfgfilepath := "~/.aws/config"
+	if os.Getenv("AWS_CONFIG_FILE") != "" {
+		cfgfilepath = os.Getenv("AWS_CONFIG_FILE")
+	}
+
+	cfgfile, err := homedir.Expand(cfgfilepath)
+	if err != nil {
+		return err
+	}
+
+	section := fmt.Sprintf("profile %s", s.options.Profile)
+	if s.options.Profile == "default" {
+		section = "default"
+	}
+
+	if s.options.Mode != "csm" {
+		caBundlePath, err := homedir.Expand(s.options.CABundle)
+		if err != nil {
+			return err
+		}
+		err = setConfigKey(cfgfile, section, fmt.Sprintf("ca_bundle = %s", caBundlePath), unset)
+		if err != nil || s.options.Mode == "proxy" {
+			return err
+		}
+	}
+
+	return setConfigKey(cfgfile, section, "csm_enabled = true", unset)
+}
+
+// defaultSession is the session run by Run and RunWithArgs, which the package-level functions act on
+var defaultSession *Session
+
+// idleSession stands in for the default session before Run or RunWithArgs is called, so the package-level functions
+// act on the same empty session each time rather than a new one per call
+var idleSession *Session
+var idleSessionOnce sync.Once
+
+// getDefaultSession returns the session run by Run or RunWithArgs, or the idle session when neither has been called
+func getDefaultSession() *Session {
+	if defaultSession == nil {
+		idleSessionOnce.Do(func() {
+			options := Options{}
+			options.setDefaults()
+			idleSession = &Session{options: options, stopped: make(chan struct{})}
+		})
+		return idleSession
+	}
+
+	return defaultSession
+}
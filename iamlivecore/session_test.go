@@ -0,0 +1,39 @@
+package iamlivecore
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestStartFailureStopsSession(t *testing.T) {
+	s, err := NewSession(Options{Mode: "csm", Provider: "aws", CSMListen: "unix:"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Start(context.Background()); err == nil {
+		t.Fatal("expected an error for a CSM listen address without a socket path")
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- s.Wait()
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("expected Wait to return the start error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Wait didn't return after Start failed")
+	}
+}
+
+func TestGetDefaultSessionIsStable(t *testing.T) {
+	if defaultSession != nil {
+		t.Skip("a default session is running")
+	}
+	if getDefaultSession() != getDefaultSession() {
+		t.Error("expected the same idle session on each call")
+	}
+}
@@ -0,0 +1,239 @@
+package iamlivecore
+
+import (
+	b64 "encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/iann0036/goproxy"
+)
+
+type noProxyRule struct {
+	host string
+	port string
+	ip   net.IP
+	cidr *net.IPNet
+}
+
+type noProxyMatcher struct {
+	all   bool
+	rules []noProxyRule
+}
+
+func newNoProxyMatcher(noProxy string) *noProxyMatcher {
+	matcher := &noProxyMatcher{}
+
+	for _, item := range strings.FieldsFunc(noProxy, func(r rune) bool { return r == ',' || r == ' ' }) {
+		item = strings.ToLower(strings.TrimSpace(item))
+		if item == "" {
+			continue
+		}
+		if item == "*" {
+			matcher.all = true
+			continue
+		}
+
+		if _, cidr, err := net.ParseCIDR(item); err == nil {
+			matcher.rules = append(matcher.rules, noProxyRule{cidr: cidr})
+			continue
+		}
+
+		rule := noProxyRule{host: item}
+		if host, port, err := net.SplitHostPort(item); err == nil {
+			rule.host = host
+			rule.port = port
+		}
+		rule.host = strings.TrimPrefix(strings.Trim(rule.host, "[]"), "*")
+		rule.ip = net.ParseIP(rule.host)
+
+		matcher.rules = append(matcher.rules, rule)
+	}
+
+	return matcher
+}
+
+// matches reports whether the host:port address should bypass the upstream proxy
+func (m *noProxyMatcher) matches(addr string) bool {
+	if m.all {
+		return true
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+		port = ""
+	}
+	host = strings.ToLower(host)
+	ip := net.ParseIP(host)
+
+	for _, rule := range m.rules {
+		if rule.port != "" && rule.port != port {
+			continue
+		}
+
+		if rule.cidr != nil {
+			if ip != nil && rule.cidr.Contains(ip) {
+				return true
+			}
+			continue
+		}
+
+		if rule.ip != nil {
+			if ip != nil && rule.ip.Equal(ip) {
+				return true
+			}
+			continue
+		}
+
+		domain := strings.TrimPrefix(rule.host, ".")
+		if host == domain || strings.HasSuffix(host, "."+domain) { // domain and its subdomains
+			return true
+		}
+	}
+
+	return false
+}
+
+func isLoopbackHost(host string) bool {
+	if host == "localhost" || host == "" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && (ip.IsLoopback() || ip.IsUnspecified())
+}
+
+// isOwnProxyAddr reports whether a proxy address points back at the iamlive listener
+func isOwnProxyAddr(proxyHost, bindAddr string) bool {
+	host, port, err := net.SplitHostPort(proxyHost)
+	if err != nil {
+		return false
+	}
+	bindHost, bindPort, err := net.SplitHostPort(bindAddr)
+	if err != nil {
+		return false
+	}
+
+	if port != bindPort {
+		return false
+	}
+
+	return host == bindHost || (isLoopbackHost(host) && isLoopbackHost(bindHost))
+}
+
+func (s *Session) getUpstreamProxyURL(bindAddr string) (*url.URL, error) {
+	upstream := s.options.UpstreamProxy
+	fromEnv := false
+
+	if upstream == "" {
+		for _, envName := range []string{"HTTPS_PROXY", "https_proxy", "HTTP_PROXY", "http_proxy"} {
+			if os.Getenv(envName) != "" {
+				upstream = os.Getenv(envName)
+				fromEnv = true
+				break
+			}
+		}
+	}
+
+	if upstream == "" {
+		return nil, nil
+	}
+
+	if !strings.Contains(upstream, "://") {
+		upstream = "http://" + upstream
+	}
+
+	proxyURL, err := url.Parse(upstream)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upstream proxy %q: %v", upstream, err)
+	}
+
+	switch proxyURL.Scheme {
+	case "http":
+		if proxyURL.Port() == "" {
+			proxyURL.Host += ":80"
+		}
+	case "https":
+		if proxyURL.Port() == "" {
+			proxyURL.Host += ":443"
+		}
+	default:
+		return nil, fmt.Errorf("unsupported upstream proxy scheme %q", proxyURL.Scheme)
+	}
+
+	// the environment of the shell running iamlive commonly points at iamlive itself
+	if fromEnv && isOwnProxyAddr(proxyURL.Host, bindAddr) {
+		return nil, nil
+	}
+
+	return proxyURL, nil
+}
+
+func (s *Session) getNoProxy() string {
+	if s.options.NoProxy != "" {
+		return s.options.NoProxy
+	}
+	if os.Getenv("NO_PROXY") != "" {
+		return os.Getenv("NO_PROXY")
+	}
+	return os.Getenv("no_proxy")
+}
+
+// setUpstreamProxy chains both MITM'd requests and passthrough CONNECT tunnels through the upstream proxy
+func (s *Session) setUpstreamProxy(proxy *goproxy.ProxyHttpServer, bindAddr string) error {
+	proxyURL, err := s.getUpstreamProxyURL(bindAddr)
+	if err != nil {
+		return err
+	}
+
+	if proxyURL == nil {
+		proxy.Tr.Proxy = nil
+		proxy.ConnectDial = nil
+		return nil
+	}
+
+	noProxy := newNoProxyMatcher(s.getNoProxy())
+
+	// the transport adds the Proxy-Authorization header from the URL userinfo itself
+	proxy.Tr.Proxy = func(req *http.Request) (*url.URL, error) {
+		addr := req.URL.Host
+		if req.URL.Port() == "" {
+			if req.URL.Scheme == "https" {
+				addr += ":443"
+			} else {
+				addr += ":80"
+			}
+		}
+		if noProxy.matches(addr) {
+			return nil, nil
+		}
+		return proxyURL, nil
+	}
+
+	proxyAuth := ""
+	if proxyURL.User != nil {
+		password, _ := proxyURL.User.Password()
+		proxyAuth = "Basic " + b64.StdEncoding.EncodeToString([]byte(proxyURL.User.Username()+":"+password))
+	}
+
+	upstreamDial := proxy.NewConnectDialToProxyWithHandler(proxyURL.String(), func(req *http.Request) {
+		if proxyAuth != "" {
+			req.Header.Set("Proxy-Authorization", proxyAuth)
+		}
+	})
+	if upstreamDial == nil {
+		return fmt.Errorf("unable to use upstream proxy %s", proxyURL.Redacted())
+	}
+
+	proxy.ConnectDial = func(network, addr string) (net.Conn, error) {
+		if noProxy.matches(addr) {
+			return net.Dial(network, addr)
+		}
+		return upstreamDial(network, addr)
+	}
+
+	return nil
+}
@@ -0,0 +1,429 @@
+package iamlivecore
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// mapIssue is a problem found in a mapping file, located by the line of the JSON it concerns
+type mapIssue struct {
+	line    int
+	message string
+}
+
+// validateMapSections holds the mappings of a full mapping file or of the replace and add sections of an overlay
+type validateMapSections struct {
+	iamMapBase
+	Replace iamMapBase `json:"replace"`
+	Add     iamMapBase `json:"add"`
+}
+
+type validateMapOperation struct {
+	definition ServiceDefinition
+	operation  ServiceOperation
+}
+
+type mapValidator struct {
+	lines      map[string]int                    // JSON path, keys joined by /, to line
+	operations map[string][]validateMapOperation // lowercased Service.Method to the operations of each API version
+	mappings   iamMapBase                        // the mappings the file applies to
+	issues     []mapIssue
+}
+
+// getJSONLines maps the path of every key and array element in the document to the line it starts on, also returning
+// the paths of keys given more than once in the same object
+func getJSONLines(data []byte) (map[string]int, []string, error) {
+	lineStarts := []int{0}
+	for i, b := range data {
+		if b == '\n' {
+			lineStarts = append(lineStarts, i+1)
+		}
+	}
+	lineAt := func(offset int64) int {
+		return sort.Search(len(lineStarts), func(i int) bool { return int64(lineStarts[i]) > offset-1 })
+	}
+
+	lines := map[string]int{}
+	duplicates := []string{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+
+	var walk func(path string) error
+	walk = func(path string) error {
+		token, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		if _, ok := lines[path]; !ok {
+			lines[path] = lineAt(dec.InputOffset())
+		}
+
+		switch token {
+		case json.Delim('{'):
+			for dec.More() {
+				key, err := dec.Token()
+				if err != nil {
+					return err
+				}
+				keyPath := path + "/" + key.(string)
+				if _, ok := lines[keyPath]; ok {
+					duplicates = append(duplicates, keyPath)
+				}
+				lines[keyPath] = lineAt(dec.InputOffset())
+				if err := walk(keyPath); err != nil {
+					return err
+				}
+			}
+		case json.Delim('['):
+			for i := 0; dec.More(); i++ {
+				if err := walk(fmt.Sprintf("%s/%d", path, i)); err != nil {
+					return err
+				}
+			}
+		default:
+			return nil
+		}
+
+		_, err = dec.Token() // closing delimiter
+		return err
+	}
+
+	return lines, duplicates, walk("")
+}
+
+func (v *mapValidator) report(path string, format string, a ...interface{}) {
+	line, ok := v.lines[path]
+	for !ok && path != "" { // fall back to the nearest enclosing value
+		path = path[:strings.LastIndex(path, "/")]
+		line, ok = v.lines[path]
+	}
+
+	v.issues = append(v.issues, mapIssue{
+		line:    line,
+		message: fmt.Sprintf(format, a...),
+	})
+}
+
+// getSARPrivilege finds an action in the IAM definition, returning whether its service prefix is known
+func getSARPrivilege(action string) (iamDefService, *iamDefPrivilege, bool) {
+	actionParts := strings.SplitN(action, ":", 2)
+	for _, service := range iamDef {
+		if service.Prefix == strings.ToLower(actionParts[0]) {
+			for i, privilege := range service.Privileges {
+				if len(actionParts) == 2 && strings.ToLower(privilege.Privilege) == strings.ToLower(actionParts[1]) {
+					return service, &service.Privileges[i], true
+				}
+			}
+			return service, nil, true
+		}
+	}
+
+	return iamDefService{}, nil, false
+}
+
+// getSARResourceArns returns the ARN templates of the resource types a privilege is authorized against
+func getSARResourceArns(service iamDefService, privilege iamDefPrivilege) map[string]string {
+	arns := map[string]string{}
+	for _, resourceType := range privilege.ResourceTypes {
+		resourceTypeName := strings.Replace(resourceType.ResourceType, "*", "", -1)
+		if resourceTypeName == "" {
+			continue
+		}
+		arns[resourceTypeName] = ""
+		for _, resource := range service.Resources {
+			if resource.Resource == resourceTypeName {
+				arns[resourceTypeName] = resource.Arn
+			}
+		}
+	}
+
+	return arns
+}
+
+// isInputMember checks a flattened parameter name, such as BlockDeviceMappings[].Ebs.KmsKeyId, against the input
+// shape of the operation, also accepting the names bound in its URI and host prefix
+func isInputMember(op validateMapOperation, name string) bool {
+	for _, template := range []string{op.operation.Http.RequestURI, op.operation.Endpoint.HostPrefix} {
+		for _, templateMatch := range regexp.MustCompile(`{([^}]+?)\+?}`).FindAllStringSubmatch(template, -1) {
+			if templateMatch[1] == name {
+				return true
+			}
+		}
+	}
+
+	shapes := op.definition.Shapes
+	shape := shapes[op.operation.Input.Shape]
+	for _, segment := range strings.Split(name, ".") {
+		segment = strings.Replace(segment, "[]", "", -1)
+
+		switch shape.Type {
+		case "map":
+			return true // keys are free-form
+		case "structure":
+		default:
+			return false
+		}
+
+		var member *ServiceStructure
+		for memberName, memberShape := range shape.Members {
+			if strings.ToLower(segment) == strings.ToLower(memberName) || (memberShape.LocationName != "" && segment == memberShape.LocationName) || (memberShape.QueryName != "" && segment == memberShape.QueryName) {
+				memberShape := memberShape
+				member = &memberShape
+				break
+			}
+		}
+		if member == nil {
+			switch segment {
+			case "member", "entry", "item", "key", "value": // wrappers of serialized lists and maps
+				continue
+			}
+			return false
+		}
+
+		shape = shapes[member.Shape]
+		for shape.Type == "list" && shape.Member != nil {
+			shape = shapes[shape.Member.Shape]
+		}
+	}
+
+	return true
+}
+
+// checkSpecial checks the %%function%argument%...%% construct of a template resolves as resolveSpecials expects
+func (v *mapValidator) checkSpecial(path string, template string, resourceMapping bool) {
+	count := strings.Count(template, "%%")
+	if count == 0 {
+		return
+	}
+	if count == 1 {
+		v.report(path, "unterminated special in %q", template)
+		return
+	}
+	if count > 2 {
+		v.report(path, "more than one special in %q, only the outermost %%%%...%%%% is resolved", template)
+	}
+
+	startIndex := strings.Index(template, "%%")
+	endIndex := strings.LastIndex(template, "%%")
+	parts := strings.Split(template[startIndex+2:endIndex], "%")
+
+	if len(parts) < 2 {
+		v.report(path, "special %%%%%s%%%% has no arguments and resolves to *", parts[0])
+		return
+	}
+
+	argCountValid := true
+	switch parts[0] {
+	case "iftruthy":
+		argCountValid = len(parts) == 3 || len(parts) == 4
+	case "urlencode":
+		argCountValid = len(parts) == 2
+	case "iftemplatematch":
+		argCountValid = len(parts) == 2
+		if !resourceMapping {
+			v.report(path, "iftemplatematch is only resolved in resource_mappings and resourcearn_mappings, resolves to *")
+		}
+	case "many":
+	case "regex":
+		argCountValid = len(parts) == 3
+		if argCountValid {
+			expression := parts[2]
+			if len(expression) > 2 && expression[0] == '/' {
+				expression = expression[1 : len(expression)-2]
+			}
+			if _, err := regexp.Compile(expression); err != nil {
+				v.report(path, "invalid regex in special: %v", err)
+			} else if regexp.MustCompile(expression).NumSubexp() < 1 {
+				v.report(path, "regex in special has no capture group")
+			}
+		}
+	default:
+		v.report(path, "unknown special function %q resolves to *", parts[0])
+		return
+	}
+
+	if !argCountValid {
+		v.report(path, "special %q has the wrong number of arguments (%d) and resolves to *", parts[0], len(parts)-1)
+	}
+}
+
+// checkTemplate checks the specials and variables of an ARN or resource template
+func (v *mapValidator) checkTemplate(path string, method string, template string, resourceMapping bool) {
+	v.checkSpecial(path, template, resourceMapping)
+
+	ops, reachable := v.operations[strings.ToLower(method)]
+	if !reachable {
+		return
+	}
+
+VariableLoop:
+	for _, variableMatch := range arnVariableRegex.FindAllStringSubmatch(template, -1) {
+		variable := variableMatch[1]
+		if variable == "Partition" || variable == "Region" || variable == "Account" || strings.Contains(variable, ":") { // policy variables such as ${aws:username}
+			continue
+		}
+		for _, op := range ops {
+			if isInputMember(op, variable) {
+				continue VariableLoop
+			}
+		}
+		v.report(path, "template variable ${%s} names no input member of %s", variable, method)
+	}
+}
+
+func (v *mapValidator) checkMappings(sectionPath string, section iamMapBase) {
+	permissionless := append(append([]string{}, v.mappings.SDKPermissionlessActions...), section.SDKPermissionlessActions...)
+
+	methods := []string{}
+	for method := range section.SDKMethodIAMMappings {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+
+	for _, method := range methods {
+		methodPath := sectionPath + "/sdk_method_iam_mappings/" + method
+
+		_, hasOperation := v.operations[strings.ToLower(method)]
+		_, isDataPlane := awsDataPlaneIAMMappings[method]
+		if !hasOperation && !isDataPlane {
+			v.report(methodPath, "mapping for %s is unreachable, no API definition has this method", method)
+		}
+		if _, ok := findMapKey(permissionless, method); ok {
+			v.report(methodPath, "mapping for %s is unreachable, the method is listed in sdk_permissionless_actions", method)
+		}
+
+		for i, mapping := range section.SDKMethodIAMMappings[method] {
+			mappingPath := fmt.Sprintf("%s/%d", methodPath, i)
+
+			service, privilege, serviceKnown := getSARPrivilege(mapping.Action)
+			if !strings.Contains(mapping.Action, ":") {
+				v.report(mappingPath+"/action", "malformed action %q", mapping.Action)
+			} else if !serviceKnown {
+				v.report(mappingPath+"/action", "unknown service prefix in action %s", mapping.Action)
+			} else if privilege == nil {
+				v.report(mappingPath+"/action", "unknown action %s", mapping.Action)
+			}
+
+			var resourceArns map[string]string
+			if privilege != nil {
+				resourceArns = getSARResourceArns(service, *privilege)
+			}
+
+			if mapping.ArnOverride.Template != "" {
+				v.checkTemplate(mappingPath+"/arn_override/template", method, mapping.ArnOverride.Template, false)
+			}
+
+			for resourceType, template := range mapping.ResourceARNMappings {
+				resourcePath := mappingPath + "/resourcearn_mappings/" + resourceType
+				if _, ok := resourceArns[resourceType]; privilege != nil && !ok {
+					v.report(resourcePath, "unknown resource type %q for action %s", resourceType, mapping.Action)
+				}
+				v.checkTemplate(resourcePath, method, template, true)
+			}
+
+			for variable, resourceMapping := range mapping.ResourceMappings {
+				resourcePath := mappingPath + "/resource_mappings/" + variable
+				if privilege != nil {
+					found := false
+					for _, arn := range resourceArns {
+						if strings.Contains(arn, "${"+variable+"}") {
+							found = true
+						}
+					}
+					if !found {
+						v.report(resourcePath, "resource_mappings variable %q appears in no resource ARN of action %s", variable, mapping.Action)
+					}
+				}
+				v.checkTemplate(resourcePath+"/template", method, resourceMapping.Template, true)
+			}
+		}
+	}
+
+	for sdkService, iamService := range section.SDKServiceMappings {
+		if _, _, ok := getSARPrivilege(iamService); !ok {
+			v.report(sectionPath+"/sdk_service_mappings/"+sdkService, "unknown service prefix %q", iamService)
+		}
+	}
+}
+
+// validateMapFile checks an AWS mapping or overlay file against the IAM definition and API definitions
+func (s *Session) validateMapFile(path string) ([]mapIssue, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var sections validateMapSections
+	if err := json.Unmarshal(data, &sections); err != nil {
+		return nil, err
+	}
+
+	lines, duplicates, err := getJSONLines(data)
+	if err != nil {
+		return nil, err
+	}
+
+	// the service name aliases of the file apply to the methods it maps, without changing those of the session
+	fileAliases := map[string]string{}
+	for _, aliases := range []map[string]string{sections.SDKServiceNameAliases, sections.Replace.SDKServiceNameAliases, sections.Add.SDKServiceNameAliases} {
+		for service, alias := range aliases {
+			fileAliases[service] = alias
+		}
+	}
+
+	v := mapValidator{
+		lines:      lines,
+		operations: map[string][]validateMapOperation{},
+		mappings:   s.iamMap,
+	}
+
+	for _, serviceDefinition := range serviceDefinitions {
+		service := s.getAWSServiceName(serviceDefinition.Metadata)
+		if alias, ok := fileAliases[getSDKServiceName(serviceDefinition.Metadata)]; ok {
+			service = alias
+		}
+		for operationName, operation := range serviceDefinition.Operations {
+			key := strings.ToLower(service + "." + operationName)
+			v.operations[key] = append(v.operations[key], validateMapOperation{
+				definition: serviceDefinition,
+				operation:  operation,
+			})
+		}
+	}
+
+	for _, duplicate := range duplicates {
+		v.report(duplicate, "duplicate key %q, only the last is used", duplicate[strings.LastIndex(duplicate, "/")+1:])
+	}
+
+	v.checkMappings("", sections.iamMapBase)
+	v.checkMappings("/replace", sections.Replace)
+	v.checkMappings("/add", sections.Add)
+
+	sort.Slice(v.issues, func(i, j int) bool {
+		if v.issues[i].line != v.issues[j].line {
+			return v.issues[i].line < v.issues[j].line
+		}
+		return v.issues[i].message < v.issues[j].message
+	})
+
+	return v.issues, nil
+}
+
+// printMapValidation prints each issue found in the mapping file, returning whether there were none
+func (s *Session) printMapValidation(path string) bool {
+	issues, err := s.validateMapFile(path)
+	if err != nil {
+		fmt.Printf("%s: ERROR: %v\n", path, err)
+		return false
+	}
+
+	for _, issue := range issues {
+		fmt.Printf("%s:%d: %s\n", path, issue.line, issue.message)
+	}
+
+	return len(issues) == 0
+}
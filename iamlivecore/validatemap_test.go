@@ -0,0 +1,22 @@
+package iamlivecore
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestValidateMapFileLeavesAliases(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "overlay.json")
+	if err := os.WriteFile(path, []byte(`{"replace": {"sdk_service_name_aliases": {"SomeService": "Other"}}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Session{}
+	if _, err := s.validateMapFile(path); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.iamMap.SDKServiceNameAliases) != 0 {
+		t.Errorf("aliases of the session changed to %v", s.iamMap.SDKServiceNameAliases)
+	}
+}
@@ -0,0 +1,241 @@
+// Package iamlivetest captures the AWS calls made by the code under test and fails the test when they need
+// permissions a checked-in policy doesn't grant.
+package iamlivetest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/iann0036/iamlive/iamlivecore"
+)
+
+// Capture is the session recording the calls of a test
+type Capture struct {
+	Session *iamlivecore.Session
+	t       testing.TB
+}
+
+// Record returns a capture recording the requests sent through its Transport or Client, in proxy mode unless
+// options say otherwise
+func Record(t testing.TB, options iamlivecore.Options) *Capture {
+	t.Helper()
+
+	if options.Mode == "" {
+		options.Mode = "proxy"
+	}
+
+	session, err := iamlivecore.NewSession(options)
+	if err != nil {
+		t.Fatalf("iamlive: %v", err)
+	}
+
+	return &Capture{
+		Session: session,
+		t:       t,
+	}
+}
+
+// Start returns a capture also listening for CSM events or proxied requests, as set by options, until the test ends
+func Start(t testing.TB, options iamlivecore.Options) *Capture {
+	t.Helper()
+
+	c := Record(t, options)
+	if err := c.Session.Start(context.Background()); err != nil {
+		t.Fatalf("iamlive: %v", err)
+	}
+	t.Cleanup(func() {
+		c.Session.Stop()
+	})
+
+	return c
+}
+
+// Transport wraps transport, http.DefaultTransport when nil, to record the requests sent through it
+func (c *Capture) Transport(transport http.RoundTripper) http.RoundTripper {
+	return c.Session.RoundTripper(transport)
+}
+
+// Client returns an HTTP client recording the requests sent through it
+func (c *Capture) Client() *http.Client {
+	return &http.Client{Transport: c.Transport(nil)}
+}
+
+// AssertPolicy fails the test when the AWS policy of the calls captured so far needs an action or resource the policy
+// file doesn't allow, listing those missing
+func (c *Capture) AssertPolicy(path string) {
+	c.t.Helper()
+
+	AssertPolicySubset(c.t, c.Session.ProviderPolicyDocument("aws"), path)
+}
+
+// AssertPolicySubset fails the test when the policy document needs an action or resource the policy file doesn't
+// allow, listing those missing
+func AssertPolicySubset(t testing.TB, policy []byte, path string) {
+	t.Helper()
+
+	allowedDoc, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("iamlive: %v", err)
+	}
+
+	missing, err := getMissingPermissions(policy, allowedDoc)
+	if err != nil {
+		t.Fatalf("iamlive: %v", err)
+	}
+
+	if len(missing) > 0 {
+		t.Errorf("iamlive: the calls made need permissions %s doesn't grant:\n%s", path, strings.Join(missing, "\n"))
+	}
+}
+
+// policyDocument is an IAM policy, where actions and resources may be a string or a list
+type policyDocument struct {
+	Statement policyStatements `json:"Statement"`
+}
+
+type policyStatement struct {
+	Effect      string      `json:"Effect"`
+	Action      stringOrSet `json:"Action"`
+	NotAction   stringOrSet `json:"NotAction"`
+	Resource    stringOrSet `json:"Resource"`
+	NotResource stringOrSet `json:"NotResource"`
+}
+
+type policyStatements []policyStatement
+
+type stringOrSet []string
+
+func (s *stringOrSet) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*s = []string{single}
+		return nil
+	}
+
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	*s = list
+	return nil
+}
+
+func (s *policyStatements) UnmarshalJSON(data []byte) error {
+	var single policyStatement
+	if err := json.Unmarshal(data, &single); err == nil {
+		*s = []policyStatement{single}
+		return nil
+	}
+
+	var list []policyStatement
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	*s = list
+	return nil
+}
+
+// matchesWildcard reports whether the value matches the IAM pattern, where * matches any run of characters and ?
+// any single character
+func matchesWildcard(pattern, value string) bool {
+	if pattern == "" {
+		return value == ""
+	}
+
+	switch pattern[0] {
+	case '*':
+		for i := 0; i <= len(value); i++ {
+			if matchesWildcard(pattern[1:], value[i:]) {
+				return true
+			}
+		}
+		return false
+	case '?':
+		return value != "" && matchesWildcard(pattern[1:], value[1:])
+	}
+
+	return value != "" && pattern[0] == value[0] && matchesWildcard(pattern[1:], value[1:])
+}
+
+func matchesAny(patterns []string, value string, ignoreCase bool) bool {
+	for _, pattern := range patterns {
+		if ignoreCase && matchesWildcard(strings.ToLower(pattern), strings.ToLower(value)) {
+			return true
+		}
+		if !ignoreCase && matchesWildcard(pattern, value) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// applies reports whether the statement covers the action on the resource, ignoring conditions
+func (statement policyStatement) applies(action, resource string) bool {
+	if statement.Action != nil && !matchesAny(statement.Action, action, true) {
+		return false
+	}
+	if statement.NotAction != nil && matchesAny(statement.NotAction, action, true) {
+		return false
+	}
+	if statement.Resource != nil && !matchesAny(statement.Resource, resource, false) {
+		return false
+	}
+	if statement.NotResource != nil && matchesAny(statement.NotResource, resource, false) {
+		return false
+	}
+
+	return true
+}
+
+// getMissingPermissions returns each action and resource of the policy which the allowed policy doesn't allow or
+// explicitly denies, sorted
+func getMissingPermissions(policy, allowedPolicy []byte) ([]string, error) {
+	var needed, allowed policyDocument
+	if err := json.Unmarshal(policy, &needed); err != nil {
+		return nil, fmt.Errorf("error parsing the captured policy: %v", err)
+	}
+	if err := json.Unmarshal(allowedPolicy, &allowed); err != nil {
+		return nil, fmt.Errorf("error parsing the policy file: %v", err)
+	}
+
+	missing := map[string]bool{}
+
+	for _, neededStatement := range needed.Statement {
+		for _, action := range neededStatement.Action {
+			for _, resource := range neededStatement.Resource {
+				isAllowed, isDenied := false, false
+				for _, statement := range allowed.Statement {
+					if !statement.applies(action, resource) {
+						continue
+					}
+					if statement.Effect == "Deny" {
+						isDenied = true
+					} else if statement.Effect == "Allow" {
+						isAllowed = true
+					}
+				}
+
+				if isDenied {
+					missing[fmt.Sprintf("  - %s on %s (denied)", action, resource)] = true
+				} else if !isAllowed {
+					missing[fmt.Sprintf("  - %s on %s", action, resource)] = true
+				}
+			}
+		}
+	}
+
+	lines := []string{}
+	for line := range missing {
+		lines = append(lines, line)
+	}
+	sort.Strings(lines)
+
+	return lines, nil
+}
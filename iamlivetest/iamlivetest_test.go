@@ -0,0 +1,125 @@
+package iamlivetest
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMatchesWildcard(t *testing.T) {
+	tests := []struct {
+		pattern string
+		value   string
+		want    bool
+	}{
+		{"s3:GetObject", "s3:GetObject", true},
+		{"s3:GetObject", "s3:GetObjectAcl", false},
+		{"s3:*", "s3:GetObject", true},
+		{"s3:Get*", "s3:PutObject", false},
+		{"*", "", true},
+		{"s3:*Object", "s3:GetObject", true},
+		{"s3:*Object", "s3:GetObjectAcl", false},
+		{"s3:?etObject", "s3:GetObject", true},
+		{"s3:?etObject", "s3:etObject", false},
+		{"arn:aws:s3:::bucket/*", "arn:aws:s3:::bucket/a/b", true},
+		{"arn:aws:s3:::bucket/*", "arn:aws:s3:::bucket2/a", false},
+		{"", "", true},
+		{"", "a", false},
+	}
+
+	for _, test := range tests {
+		if got := matchesWildcard(test.pattern, test.value); got != test.want {
+			t.Errorf("matchesWildcard(%q, %q) = %v, want %v", test.pattern, test.value, got, test.want)
+		}
+	}
+}
+
+func TestGetMissingPermissions(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  string
+		allowed string
+		want    []string
+	}{
+		{
+			name:    "allowed",
+			policy:  `{"Statement": [{"Effect": "Allow", "Action": ["s3:GetObject"], "Resource": "arn:aws:s3:::bucket/key"}]}`,
+			allowed: `{"Statement": [{"Effect": "Allow", "Action": "s3:GetObject", "Resource": "arn:aws:s3:::bucket/*"}]}`,
+			want:    []string{},
+		},
+		{
+			name:    "missing action",
+			policy:  `{"Statement": [{"Effect": "Allow", "Action": ["s3:GetObject", "s3:PutObject"], "Resource": "arn:aws:s3:::bucket/key"}]}`,
+			allowed: `{"Statement": [{"Effect": "Allow", "Action": "s3:GetObject", "Resource": "*"}]}`,
+			want:    []string{"  - s3:PutObject on arn:aws:s3:::bucket/key"},
+		},
+		{
+			name:    "missing resource",
+			policy:  `{"Statement": [{"Effect": "Allow", "Action": ["s3:GetObject"], "Resource": ["arn:aws:s3:::bucket/key", "arn:aws:s3:::other/key"]}]}`,
+			allowed: `{"Statement": [{"Effect": "Allow", "Action": "s3:GetObject", "Resource": "arn:aws:s3:::bucket/*"}]}`,
+			want:    []string{"  - s3:GetObject on arn:aws:s3:::other/key"},
+		},
+		{
+			name:   "deny overrides allow",
+			policy: `{"Statement": [{"Effect": "Allow", "Action": ["s3:DeleteObject", "s3:GetObject"], "Resource": "arn:aws:s3:::bucket/key"}]}`,
+			allowed: `{"Statement": [
+				{"Effect": "Allow", "Action": "s3:*", "Resource": "*"},
+				{"Effect": "Deny", "Action": "s3:Delete*", "Resource": "arn:aws:s3:::bucket/*"}
+			]}`,
+			want: []string{"  - s3:DeleteObject on arn:aws:s3:::bucket/key (denied)"},
+		},
+		{
+			name:    "not action",
+			policy:  `{"Statement": [{"Effect": "Allow", "Action": ["iam:CreateUser", "s3:GetObject"], "Resource": "*"}]}`,
+			allowed: `{"Statement": [{"Effect": "Allow", "NotAction": "iam:*", "Resource": "*"}]}`,
+			want:    []string{"  - iam:CreateUser on *"},
+		},
+		{
+			name:    "not resource",
+			policy:  `{"Statement": [{"Effect": "Allow", "Action": ["s3:GetObject"], "Resource": ["arn:aws:s3:::public/key", "arn:aws:s3:::secret/key"]}]}`,
+			allowed: `{"Statement": [{"Effect": "Allow", "Action": "s3:GetObject", "NotResource": "arn:aws:s3:::secret/*"}]}`,
+			want:    []string{"  - s3:GetObject on arn:aws:s3:::secret/key"},
+		},
+		{
+			name:    "question mark wildcard",
+			policy:  `{"Statement": [{"Effect": "Allow", "Action": ["ec2:DescribeInstances"], "Resource": ["arn:aws:ec2:us-east-1:123456789012:instance/i-1", "arn:aws:ec2:us-east-1:123456789012:instance/i-12"]}]}`,
+			allowed: `{"Statement": [{"Effect": "Allow", "Action": "ec2:DescribeInstances", "Resource": "arn:aws:ec2:us-east-1:123456789012:instance/i-?"}]}`,
+			want:    []string{"  - ec2:DescribeInstances on arn:aws:ec2:us-east-1:123456789012:instance/i-12"},
+		},
+		{
+			name:    "actions ignore case",
+			policy:  `{"Statement": [{"Effect": "Allow", "Action": ["s3:GetObject"], "Resource": "arn:aws:s3:::bucket/key"}]}`,
+			allowed: `{"Statement": [{"Effect": "Allow", "Action": "S3:getobject", "Resource": "arn:aws:s3:::bucket/key"}]}`,
+			want:    []string{},
+		},
+		{
+			name:    "resources match case",
+			policy:  `{"Statement": [{"Effect": "Allow", "Action": ["s3:GetObject"], "Resource": "arn:aws:s3:::bucket/Key"}]}`,
+			allowed: `{"Statement": [{"Effect": "Allow", "Action": "s3:GetObject", "Resource": "arn:aws:s3:::bucket/key"}]}`,
+			want:    []string{"  - s3:GetObject on arn:aws:s3:::bucket/Key"},
+		},
+		{
+			name:    "single statement object",
+			policy:  `{"Statement": [{"Effect": "Allow", "Action": ["sqs:SendMessage", "sqs:DeleteQueue"], "Resource": "*"}]}`,
+			allowed: `{"Statement": {"Effect": "Allow", "Action": "sqs:SendMessage", "Resource": "*"}}`,
+			want:    []string{"  - sqs:DeleteQueue on *"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := getMissingPermissions([]byte(test.policy), []byte(test.allowed))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestGetMissingPermissionsInvalid(t *testing.T) {
+	if _, err := getMissingPermissions([]byte(`{}`), []byte(`not json`)); err == nil {
+		t.Error("expected an error for an invalid policy file")
+	}
+}